@@ -0,0 +1,364 @@
+// Command platform-dupe generates Dupe methods for controllers, so the
+// router doesn't need to duplicate them with reflection on each request.
+//
+// Controllers are selected with the -type flag, or by a platform:dupe
+// comment on the type:
+//
+//	//go:generate platform-dupe
+//
+//	//platform:dupe
+//	type PostsCtrl struct {
+//		*router.BaseController
+//		DB *sql.DB `dupe:"no"`
+//	}
+//
+// The generated Dupe duplicates controllers the same way as the Router
+// does without a Dupe method: pointers to structs are replaced with
+// pointers to copies, embedded pointers that are nil are set to a new
+// struct, fields tagged dupe:"zero" are cleared and fields tagged
+// dupe:"no" are shared. Struct values, including embedded and unexported
+// embedded structs, are duplicated field by field. The generated code only
+// copies one level of pointers, so platform-dupe refuses controllers the
+// Router would copy more deeply, like a pointer to a struct that has
+// pointers to structs, a pointer to a struct from another package other
+// than router.BaseController, or a field tagged dupe:"deep". Tag those
+// fields dupe:"no" or write the Dupe method by hand.
+//
+// With -tests, types in the _test.go files of the package are used too,
+// the output file must then be a _test.go file.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const routerPath = "github.com/acsellers/platform/router"
+
+// sourceImporter type checks imported packages from source, it is shared
+// so packages are only checked once.
+var sourceImporter = importer.ForCompiler(token.NewFileSet(), "source", nil)
+
+func main() {
+	types := flag.String("type", "", "comma separated list of controller types, instead of platform:dupe comments")
+	output := flag.String("o", "dupe_gen.go", "output file name")
+	tests := flag.Bool("tests", false, "include types from _test.go files")
+	flag.Parse()
+	dir := "."
+	if flag.NArg() > 0 {
+		dir = flag.Arg(0)
+	}
+
+	var names []string
+	if *types != "" {
+		names = strings.Split(*types, ",")
+	}
+	src, err := generate(dir, names, *output, *tests)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, *output), src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// controller is a struct type that needs a Dupe method.
+type controller struct {
+	name   string
+	fields []field
+}
+
+// field is a field of a controller that isn't just copied with the
+// controller, name is the selector for it like base.Current.
+type field struct {
+	name string
+	zero bool
+	// alloc is set for embedded pointers, to the type to allocate when
+	// the pointer is nil
+	alloc string
+}
+
+// generator holds the type checked package the Dupe methods are
+// generated for.
+type generator struct {
+	pkg        *types.Package
+	routerName string
+}
+
+// generate builds the source for the Dupe methods of the controllers in
+// the package in dir, names selects controllers instead of comments.
+func generate(dir string, names []string, output string, tests bool) ([]byte, error) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return (tests || !strings.HasSuffix(fi.Name(), "_test.go")) && fi.Name() != output
+	}, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	for name := range pkgs {
+		if strings.HasSuffix(name, "_test") {
+			delete(pkgs, name)
+		}
+	}
+	if len(pkgs) != 1 {
+		return nil, fmt.Errorf("Expected one package in %s, found %d", dir, len(pkgs))
+	}
+
+	var pkg *ast.Package
+	for _, p := range pkgs {
+		pkg = p
+	}
+	wanted := map[string]bool{}
+	for _, name := range names {
+		wanted[strings.TrimSpace(name)] = true
+	}
+
+	fileNames := []string{}
+	for name := range pkg.Files {
+		fileNames = append(fileNames, name)
+	}
+	sort.Strings(fileNames)
+	files := []*ast.File{}
+	selected := []string{}
+	routerName := "router"
+	for _, fileName := range fileNames {
+		file := pkg.Files[fileName]
+		files = append(files, file)
+		fileRouter := ""
+		for _, imp := range file.Imports {
+			if path, _ := strconv.Unquote(imp.Path.Value); path == routerPath {
+				fileRouter = "router"
+				if imp.Name != nil {
+					fileRouter = imp.Name.Name
+				}
+			}
+		}
+		for _, decl := range file.Decls {
+			gd, ok := decl.(*ast.GenDecl)
+			if !ok || gd.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gd.Specs {
+				ts := spec.(*ast.TypeSpec)
+				if _, ok := ts.Type.(*ast.StructType); !ok {
+					continue
+				}
+				if len(names) > 0 && !wanted[ts.Name.Name] {
+					continue
+				}
+				if len(names) == 0 && !annotated(gd.Doc) && !annotated(ts.Doc) {
+					continue
+				}
+				if strings.HasSuffix(fileName, "_test.go") && !strings.HasSuffix(output, "_test.go") {
+					return nil, fmt.Errorf("Struct type %s is declared in %s, the output file %s must end in _test.go", ts.Name.Name, filepath.Base(fileName), output)
+				}
+				delete(wanted, ts.Name.Name)
+				selected = append(selected, ts.Name.Name)
+				if fileRouter != "" {
+					routerName = fileRouter
+				}
+			}
+		}
+	}
+	for name := range wanted {
+		return nil, fmt.Errorf("Struct type %s not found in %s", name, dir)
+	}
+	sort.Strings(selected)
+
+	// errors are left to the compiler, fields with types that couldn't
+	// be resolved are refused by dupedFields
+	conf := types.Config{Importer: sourceImporter, Error: func(error) {}}
+	tpkg, _ := conf.Check(pkg.Name, fset, files, nil)
+	g := generator{tpkg, routerName}
+	local := pkg.Name == "router"
+	ctrls := []controller{}
+	for _, name := range selected {
+		st := tpkg.Scope().Lookup(name).Type().Underlying().(*types.Struct)
+		fields, err := g.dupedFields(name, st, "")
+		if err != nil {
+			return nil, err
+		}
+		ctrls = append(ctrls, controller{name, fields})
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by platform-dupe. DO NOT EDIT.\n\npackage %s\n\n", pkg.Name)
+	ctrlType := "Controller"
+	if !local {
+		ctrlType = routerName + ".Controller"
+	}
+	if !local && len(ctrls) > 0 {
+		if routerName == "router" {
+			fmt.Fprintf(&buf, "import %q\n\n", routerPath)
+		} else {
+			fmt.Fprintf(&buf, "import %s %q\n\n", routerName, routerPath)
+		}
+	}
+	for _, c := range ctrls {
+		fmt.Fprintf(&buf, "// Dupe returns a copy of the %s for a request.\n", c.name)
+		fmt.Fprintf(&buf, "func (c %s) Dupe() %s {\n\td := c\n", c.name, ctrlType)
+		zeroed := false
+		for _, f := range c.fields {
+			if f.zero {
+				if !zeroed {
+					fmt.Fprintf(&buf, "\tvar zero %s\n", c.name)
+					zeroed = true
+				}
+				fmt.Fprintf(&buf, "\td.%[1]s = zero.%[1]s\n", f.name)
+				continue
+			}
+			fmt.Fprintf(&buf, "\tif c.%[1]s != nil {\n\t\tv := *c.%[1]s\n\t\td.%[1]s = &v\n\t}", f.name)
+			if f.alloc != "" {
+				fmt.Fprintf(&buf, " else {\n\t\td.%s = new(%s)\n\t}", f.name, f.alloc)
+			}
+			buf.WriteString("\n")
+		}
+		buf.WriteString("\treturn &d\n}\n\n")
+	}
+	return format.Source(buf.Bytes())
+}
+
+func annotated(doc *ast.CommentGroup) bool {
+	if doc == nil {
+		return false
+	}
+	for _, c := range doc.List {
+		if strings.TrimSpace(strings.TrimPrefix(c.Text, "//")) == "platform:dupe" {
+			return true
+		}
+	}
+	return false
+}
+
+// dupedFields returns the fields of st that are copied or cleared by the
+// Dupe method of the controller ctrl, following the plans the router
+// builds for its reflective Dupe. prefix leads to st from the controller.
+func (g generator) dupedFields(ctrl string, st *types.Struct, prefix string) ([]field, error) {
+	fields := []field{}
+	for i := 0; i < st.NumFields(); i++ {
+		f := st.Field(i)
+		if !settable(f) {
+			continue
+		}
+		name := prefix + f.Name()
+		path := ctrl + "." + name
+		if f.Type() == types.Typ[types.Invalid] {
+			return nil, fmt.Errorf("Cannot resolve the type of field %s", path)
+		}
+		switch tag := reflect.StructTag(st.Tag(i)).Get("dupe"); {
+		case tag == "no":
+			continue
+		case tag == "zero" && f.Exported():
+			fields = append(fields, field{name: name, zero: true})
+			continue
+		case tag == "deep" && f.Exported():
+			return nil, fmt.Errorf("Field %s is tagged dupe:\"deep\", which platform-dupe doesn't support, write a Dupe method for %s", path, ctrl)
+		case tag != "" && tag != "zero" && tag != "deep":
+			return nil, fmt.Errorf("Field %s has an unknown dupe tag %q", path, tag)
+		}
+
+		if sub, ok := f.Type().Underlying().(*types.Struct); ok {
+			subFields, err := g.dupedFields(ctrl, sub, name+".")
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, subFields...)
+			continue
+		}
+		ptr, ok := f.Type().Underlying().(*types.Pointer)
+		if !ok {
+			continue
+		}
+		target, ok := ptr.Elem().Underlying().(*types.Struct)
+		if !ok {
+			continue
+		}
+		typeName, ok := g.typeName(ptr.Elem())
+		if !ok {
+			return nil, fmt.Errorf("Field %s points to %s from another package, tag it dupe:\"no\" to share it or write a Dupe method for %s", path, ptr.Elem(), ctrl)
+		}
+		if copies(target, map[*types.Struct]bool{}) {
+			return nil, fmt.Errorf("Field %s has pointers to structs inside %s that platform-dupe won't copy, tag it dupe:\"no\" or write a Dupe method for %s", path, typeName, ctrl)
+		}
+		fd := field{name: name}
+		if f.Anonymous() {
+			fd.alloc = typeName
+		}
+		fields = append(fields, fd)
+	}
+	return fields, nil
+}
+
+// typeName returns the name of a struct type the generated code may copy,
+// types from the package itself and router.BaseController.
+func (g generator) typeName(t types.Type) (string, bool) {
+	named, ok := t.(*types.Named)
+	if !ok {
+		return types.TypeString(t, types.RelativeTo(g.pkg)), true
+	}
+	obj := named.Obj()
+	switch {
+	case obj.Pkg() == g.pkg:
+		return obj.Name(), true
+	case obj.Pkg() != nil && obj.Pkg().Path() == routerPath && obj.Name() == "BaseController":
+		return g.routerName + "." + obj.Name(), true
+	}
+	return "", false
+}
+
+// copies reports whether the router would copy more than the struct
+// itself when duplicating it.
+func copies(st *types.Struct, seen map[*types.Struct]bool) bool {
+	if seen[st] {
+		return false
+	}
+	seen[st] = true
+	for i := 0; i < st.NumFields(); i++ {
+		f := st.Field(i)
+		if !settable(f) {
+			continue
+		}
+		switch tag := reflect.StructTag(st.Tag(i)).Get("dupe"); {
+		case tag == "no":
+			continue
+		case (tag == "zero" || tag == "deep") && f.Exported():
+			return true
+		}
+		switch t := f.Type().Underlying().(type) {
+		case *types.Struct:
+			if copies(t, seen) {
+				return true
+			}
+		case *types.Pointer:
+			if _, ok := t.Elem().Underlying().(*types.Struct); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// settable matches dupeSettable in the router, the fields of embedded
+// structs are duplicated even when the struct type is unexported.
+func settable(f *types.Var) bool {
+	if f.Exported() {
+		return true
+	}
+	_, ok := f.Type().Underlying().(*types.Struct)
+	return f.Anonymous() && ok
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const expected = `// Code generated by platform-dupe. DO NOT EDIT.
+
+package app
+
+import pr "github.com/acsellers/platform/router"
+
+// Dupe returns a copy of the PostsCtrl for a request.
+func (c PostsCtrl) Dupe() pr.Controller {
+	d := c
+	if c.BaseController != nil {
+		v := *c.BaseController
+		d.BaseController = &v
+	} else {
+		d.BaseController = new(pr.BaseController)
+	}
+	if c.base.Cur != nil {
+		v := *c.base.Cur
+		d.base.Cur = &v
+	}
+	if c.Current != nil {
+		v := *c.Current
+		d.Current = &v
+	}
+	var zero PostsCtrl
+	d.Errors = zero.Errors
+	return &d
+}
+`
+
+func TestGenerate(t *testing.T) {
+	src, err := generate("testdata/app", nil, "dupe_gen.go", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(src) != expected {
+		t.Errorf("Unexpected output:\n%s", src)
+	}
+
+	src, err = generate("testdata/app", []string{"UsersCtrl"}, "dupe_gen.go", false)
+	if err != nil || !strings.Contains(string(src), "func (c UsersCtrl) Dupe() pr.Controller") ||
+		strings.Contains(string(src), "PostsCtrl") {
+		t.Errorf("Unexpected output for -type:\n%s %v", src, err)
+	}
+	if _, err = generate("testdata/app", []string{"MissingCtrl"}, "dupe_gen.go", false); err == nil {
+		t.Error("Expected an error for a missing type")
+	}
+
+	if _, err = generate("testdata/app", nil, "dupe_gen.go", true); err == nil || !strings.Contains(err.Error(), "must end in _test.go") {
+		t.Error("Expected an error for test types in a non-test file, got", err)
+	}
+	src, err = generate("testdata/app", nil, "dupe_gen_test.go", true)
+	if err != nil || !strings.Contains(string(src), "func (c fakeCtrl) Dupe() pr.Controller") {
+		t.Errorf("Unexpected output for -tests:\n%s %v", src, err)
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	src, err := generate("testdata/bad", nil, "dupe_gen.go", false)
+	if err != nil || strings.Contains(string(src), "import") {
+		t.Errorf("Unexpected output without controllers:\n%s %v", src, err)
+	}
+
+	for name, msg := range map[string]string{
+		"DBCtrl":     "points to database/sql.DB from another package",
+		"NestedCtrl": "pointers to structs inside Post",
+		"DeepCtrl":   "tagged dupe:\"deep\"",
+		"LinkCtrl":   "LinkCtrl.Link.User points to net/url.Userinfo",
+	} {
+		if _, err := generate("testdata/bad", []string{name}, "dupe_gen.go", false); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("Expected an error containing %q for %s, got %v", msg, name, err)
+		}
+	}
+}
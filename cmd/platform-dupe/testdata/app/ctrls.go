@@ -0,0 +1,37 @@
+package app
+
+import (
+	"database/sql"
+	"net/url"
+	"time"
+
+	pr "github.com/acsellers/platform/router"
+)
+
+//platform:dupe
+type PostsCtrl struct {
+	*pr.BaseController
+	base
+	DB      *sql.DB  `dupe:"no"`
+	Link    *url.URL `dupe:"no"`
+	Current *Post
+	Errors  map[string]string `dupe:"zero"`
+	Title   string
+	Updated time.Time
+}
+
+type base struct {
+	Cur *Post
+}
+
+type Post struct {
+	Author Author
+}
+
+type Author struct {
+	Name string
+}
+
+type UsersCtrl struct {
+	*pr.BaseController
+}
@@ -0,0 +1,6 @@
+package app
+
+//platform:dupe
+type fakeCtrl struct {
+	Current *Post
+}
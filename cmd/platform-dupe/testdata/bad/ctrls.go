@@ -0,0 +1,34 @@
+package bad
+
+import (
+	"database/sql"
+	"net/url"
+
+	"github.com/acsellers/platform/router"
+)
+
+type DBCtrl struct {
+	*router.BaseController
+	DB *sql.DB
+}
+
+type NestedCtrl struct {
+	*router.BaseController
+	Current *Post
+}
+
+type DeepCtrl struct {
+	*router.BaseController
+	Tags []string `dupe:"deep"`
+}
+
+type LinkCtrl struct {
+	*router.BaseController
+	Link url.URL
+}
+
+type Post struct {
+	Author *Author
+}
+
+type Author struct{}
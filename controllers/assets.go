@@ -46,6 +46,12 @@ func (ac AssetController) Path() string {
 	return ac.Location
 }
 
+// OtherBase adds a wildcard route so files in nested folders, like
+// css/vendor/normalize.css, are served by Show as well.
+func (ac AssetController) OtherBase(sr *router.SubRoute) {
+	sr.Get("*" + ac.Location).Action("Show")
+}
+
 func (ac AssetController) Show() router.Result {
 	fn := filepath.Join(ac.CtrlPath, ac.ID[ac.Location])
 	_, err := os.Stat(fn)
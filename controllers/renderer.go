@@ -9,7 +9,7 @@ import (
 
 type RenderableCtrl struct {
 	*router.BaseController
-	Template     *multitemplate.Template
+	Template     *multitemplate.Template `dupe:"no"`
 	Page, Layout string
 }
 
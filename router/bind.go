@@ -0,0 +1,345 @@
+package router
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxBindMemory is the memory used for multipart forms by Bind, larger
+// files are stored in temporary files.
+var MaxBindMemory int64 = 32 << 20
+
+// BindError is a value that couldn't be bound to a field.
+type BindError struct {
+	Field string
+	Value string
+	Err   error
+}
+
+func (be BindError) Error() string {
+	return fmt.Sprintf("Field '%s': %s", be.Field, be.Err)
+}
+
+// BindErrors lists every field Bind couldn't set.
+type BindErrors []BindError
+
+func (be BindErrors) Error() string {
+	msgs := make([]string, len(be))
+	for i, e := range be {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Field returns the error for a field, if there was one.
+func (be BindErrors) Field(name string) (BindError, bool) {
+	for _, e := range be {
+		if e.Field == name {
+			return e, true
+		}
+	}
+	return BindError{}, false
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	durationType   = reflect.TypeOf(time.Duration(0))
+	fileHeaderType = reflect.TypeOf((*multipart.FileHeader)(nil))
+	unmarshalType  = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// Bind sets the fields of the struct dst points to from the query string
+// and the body of the request, which may be a urlencoded or multipart
+// form, or JSON.
+//
+// Form values are matched to fields by the form tag, then the json tag,
+// then the field name. Nested structs use dotted names like address.city,
+// slices are set from repeated values, times are parsed with the layout
+// in the time tag or as RFC 3339, and multipart files are bound to
+// *multipart.FileHeader fields. A JSON body must be an object, its keys
+// are matched to fields like encoding/json does. A BindErrors is returned
+// listing every value that couldn't be converted, with the JSON text of
+// values from a JSON body.
+func (bc BaseController) Bind(dst interface{}) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Bind needs a pointer to a struct, got %T", dst)
+	}
+	if bc.Request == nil {
+		return fmt.Errorf("No request to bind")
+	}
+	req := bc.Request
+
+	errs := BindErrors{}
+	bindValues(rv.Elem(), "", req.URL.Query(), nil, &errs)
+
+	ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch {
+	case req.Body == nil || req.Method == "GET" || req.Method == "HEAD":
+	case ct == "application/json" || strings.HasSuffix(ct, "+json"):
+		fields := map[string]json.RawMessage{}
+		if err := json.NewDecoder(req.Body).Decode(&fields); err != nil && err != io.EOF {
+			return err
+		}
+		bindJSON(rv.Elem(), "", fields, &errs)
+	case ct == "multipart/form-data":
+		if err := req.ParseMultipartForm(MaxBindMemory); err != nil {
+			return err
+		}
+		bindValues(rv.Elem(), "", req.MultipartForm.Value, req.MultipartForm.File, &errs)
+	case ct == "application/x-www-form-urlencoded":
+		if err := req.ParseForm(); err != nil {
+			return err
+		}
+		bindValues(rv.Elem(), "", req.PostForm, nil, &errs)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// bindJSON sets the fields of v from the members of a JSON object, each
+// field is decoded on its own so every invalid value is reported.
+func bindJSON(v reflect.Value, prefix string, fields map[string]json.RawMessage, errs *BindErrors) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			continue
+		}
+		fv := v.Field(i)
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			bindJSON(fv, prefix, fields, errs)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		raw, ok := fields[name]
+		if !ok {
+			for k, r := range fields {
+				if strings.EqualFold(k, name) {
+					name, raw, ok = k, r, true
+					break
+				}
+			}
+		}
+		if !ok {
+			continue
+		}
+		if err := json.Unmarshal(raw, fv.Addr().Interface()); err != nil {
+			key := prefix + name
+			if te, ok := err.(*json.UnmarshalTypeError); ok && te.Field != "" {
+				key += "." + te.Field
+			}
+			*errs = append(*errs, BindError{Field: key, Value: string(raw), Err: err})
+		}
+	}
+}
+
+// bindName returns the form name of a field, or "-" to skip it.
+func bindName(f reflect.StructField) string {
+	for _, tag := range []string{"form", "json"} {
+		if name := strings.Split(f.Tag.Get(tag), ",")[0]; name != "" {
+			return name
+		}
+	}
+	return f.Name
+}
+
+func bindValues(v reflect.Value, prefix string, values url.Values, files map[string][]*multipart.FileHeader, errs *BindErrors) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		name := bindName(f)
+		if name == "-" {
+			continue
+		}
+		fv := v.Field(i)
+		ft := f.Type
+		if f.Anonymous && ft.Kind() == reflect.Struct && f.Tag.Get("form") == "" {
+			bindValues(fv, prefix, values, files, errs)
+			continue
+		}
+		if !fv.CanSet() {
+			continue
+		}
+		key := prefix + name
+
+		switch {
+		case ft == fileHeaderType:
+			if fhs := files[key]; len(fhs) > 0 {
+				fv.Set(reflect.ValueOf(fhs[0]))
+			}
+			continue
+		case ft.Kind() == reflect.Slice && ft.Elem() == fileHeaderType:
+			if fhs := files[key]; len(fhs) > 0 {
+				fv.Set(reflect.ValueOf(fhs))
+			}
+			continue
+		case ft.Kind() == reflect.Struct && ft != timeType && !reflect.PtrTo(ft).Implements(unmarshalType):
+			bindValues(fv, key+".", values, files, errs)
+			continue
+		case ft.Kind() == reflect.Ptr && ft.Elem().Kind() == reflect.Struct &&
+			ft.Elem() != timeType && !ft.Implements(unmarshalType):
+			if hasPrefix(values, key+".") {
+				if fv.IsNil() {
+					fv.Set(reflect.New(ft.Elem()))
+				}
+				bindValues(fv.Elem(), key+".", values, files, errs)
+			}
+			continue
+		}
+
+		vals, ok := values[key]
+		if !ok {
+			vals, ok = values[key+"[]"]
+		}
+		if !ok {
+			continue
+		}
+		if ft.Kind() == reflect.Slice && ft.Elem().Kind() != reflect.Uint8 {
+			sv := reflect.MakeSlice(ft, len(vals), len(vals))
+			for j, s := range vals {
+				if err := setValue(sv.Index(j), s, f.Tag); err != nil {
+					*errs = append(*errs, BindError{Field: key, Value: s, Err: err})
+				}
+			}
+			fv.Set(sv)
+			continue
+		}
+		if len(vals) == 0 {
+			continue
+		}
+		if err := setValue(fv, vals[0], f.Tag); err != nil {
+			*errs = append(*errs, BindError{Field: key, Value: vals[0], Err: err})
+		}
+	}
+}
+
+func hasPrefix(values url.Values, prefix string) bool {
+	for k := range values {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// setValue converts s to the type of v.
+func setValue(v reflect.Value, s string, tag reflect.StructTag) error {
+	if v.Kind() == reflect.Ptr {
+		if s == "" {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		nv := reflect.New(v.Type().Elem())
+		if err := setValue(nv.Elem(), s, tag); err != nil {
+			return err
+		}
+		v.Set(nv)
+		return nil
+	}
+	if tu, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok && v.Type() != timeType {
+		return tu.UnmarshalText([]byte(s))
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		// empty inputs for numbers are left blank, not invalid
+		if s == "" {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+	}
+
+	switch {
+	case v.Type() == timeType:
+		if s == "" {
+			v.Set(reflect.Zero(timeType))
+			return nil
+		}
+		layout := tag.Get("time")
+		if layout == "" {
+			layout = time.RFC3339
+		}
+		t, err := time.Parse(layout, s)
+		if err != nil && tag.Get("time") == "" {
+			// dates from <input type="date">
+			t, err = time.Parse("2006-01-02", s)
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid time '%s'", s)
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("Invalid duration '%s'", s)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		switch strings.ToLower(s) {
+		case "on", "yes":
+			v.SetBool(true)
+		case "", "off", "no":
+			v.SetBool(false)
+		default:
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return fmt.Errorf("Invalid boolean '%s'", s)
+			}
+			v.SetBool(b)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("Invalid integer '%s'", s)
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("Invalid unsigned integer '%s'", s)
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		fl, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("Invalid number '%s'", s)
+		}
+		v.SetFloat(fl)
+	case reflect.Slice:
+		// []byte
+		v.SetBytes([]byte(s))
+	default:
+		return fmt.Errorf("Cannot bind to a %s", v.Type())
+	}
+	return nil
+}
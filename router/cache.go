@@ -0,0 +1,161 @@
+package router
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Cache is an application wide store that is shared by every controller
+// of a Router, it is safe to use from multiple requests at once. Items
+// may expire after a TTL, and when MaxItems is set the least recently
+// used items are removed to stay within it.
+type Cache struct {
+	mu       sync.Mutex
+	maxItems int
+	items    map[string]*list.Element
+	// lru has the most recently used items at the front
+	lru *list.List
+	now func() time.Time
+}
+
+type cacheItem struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// NewCache creates a Cache holding at most maxItems items, a maxItems of
+// 0 means the Cache isn't bounded.
+func NewCache(maxItems int) *Cache {
+	return &Cache{
+		maxItems: maxItems,
+		items:    map[string]*list.Element{},
+		lru:      list.New(),
+		now:      time.Now,
+	}
+}
+
+// Set stores a value that doesn't expire.
+func (c *Cache) Set(key string, value interface{}) {
+	c.SetTTL(key, value, 0)
+}
+
+// SetTTL stores a value that expires after ttl, a ttl of 0 means the
+// value doesn't expire.
+func (c *Cache) SetTTL(key string, value interface{}, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item := &cacheItem{key: key, value: value}
+	if ttl > 0 {
+		item.expires = c.now().Add(ttl)
+	}
+	if e, ok := c.items[key]; ok {
+		e.Value = item
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.lru.PushFront(item)
+	if c.maxItems > 0 {
+		for c.lru.Len() > c.maxItems {
+			c.remove(c.lru.Back())
+		}
+	}
+}
+
+// Get returns the value for key, if it is present and hasn't expired.
+func (c *Cache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := e.Value.(*cacheItem)
+	if !item.expires.IsZero() && !c.now().Before(item.expires) {
+		c.remove(e)
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return item.value, true
+}
+
+// Fetch returns the value for key, calling load to create and store the
+// value if it isn't in the Cache. load is called without holding the
+// lock, so concurrent calls for a missing key may each call load.
+func (c *Cache) Fetch(key string, ttl time.Duration, load func() (interface{}, error)) (interface{}, error) {
+	if v, ok := c.Get(key); ok {
+		return v, nil
+	}
+	v, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.SetTTL(key, v, ttl)
+	return v, nil
+}
+
+func (c *Cache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.remove(e)
+	}
+}
+
+// Len returns the number of items in the Cache, including expired items
+// that haven't been removed yet.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Clear removes every item from the Cache.
+func (c *Cache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = map[string]*list.Element{}
+	c.lru.Init()
+}
+
+func (c *Cache) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.items, e.Value.(*cacheItem).key)
+}
+
+func (c *Cache) String(key string) (string, bool) {
+	v, ok := c.Get(key)
+	s, ok2 := v.(string)
+	return s, ok && ok2
+}
+
+func (c *Cache) Int(key string) (int, bool) {
+	v, ok := c.Get(key)
+	i, ok2 := v.(int)
+	return i, ok && ok2
+}
+
+func (c *Cache) Int64(key string) (int64, bool) {
+	v, ok := c.Get(key)
+	i, ok2 := v.(int64)
+	return i, ok && ok2
+}
+
+func (c *Cache) Float64(key string) (float64, bool) {
+	v, ok := c.Get(key)
+	f, ok2 := v.(float64)
+	return f, ok && ok2
+}
+
+func (c *Cache) Bool(key string) (bool, bool) {
+	v, ok := c.Get(key)
+	b, ok2 := v.(bool)
+	return b, ok && ok2
+}
+
+func (c *Cache) Time(key string) (time.Time, bool) {
+	v, ok := c.Get(key)
+	t, ok2 := v.(time.Time)
+	return t, ok && ok2
+}
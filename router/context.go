@@ -0,0 +1,140 @@
+package router
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// requestContext holds the values set with SetValue while a Router is
+// serving a request, so values set by a PreFilter are seen by the rest of
+// the request. Values set by a controller that declines the request are
+// rolled back before the next handler runs.
+type requestContext struct {
+	context.Context
+	mu     sync.RWMutex
+	values map[interface{}]interface{}
+	// services from request scoped providers, and their cleanups
+	scoped   map[*provider]*scopedService
+	cleanups []func()
+}
+
+type requestContextKey struct{}
+
+func (rc *requestContext) Value(key interface{}) interface{} {
+	if key == (requestContextKey{}) {
+		return rc
+	}
+	rc.mu.RLock()
+	v, ok := rc.values[key]
+	rc.mu.RUnlock()
+	if ok {
+		return v
+	}
+	return rc.Context.Value(key)
+}
+
+// snapshot returns a copy of the values, for restore.
+func (rc *requestContext) snapshot() map[interface{}]interface{} {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	if rc.values == nil {
+		return nil
+	}
+	values := make(map[interface{}]interface{}, len(rc.values))
+	for k, v := range rc.values {
+		values[k] = v
+	}
+	return values
+}
+
+// restore replaces the values with a snapshot.
+func (rc *requestContext) restore(values map[interface{}]interface{}) {
+	rc.mu.Lock()
+	rc.values = values
+	rc.mu.Unlock()
+}
+
+// cleanup runs the cleanups for request scoped services, in the reverse
+// of the order the services were created.
+func (rc *requestContext) cleanup() {
+	rc.mu.Lock()
+	cleanups := rc.cleanups
+	rc.cleanups = nil
+	rc.mu.Unlock()
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
+	}
+}
+
+// SetValue stores a value in the context of a request that is being
+// served by a Router. The value is visible from the Context of the
+// request in the controller action, HandlerFunc endpoints and Fallback
+// handlers, unless it was set by a controller that declined the request.
+// SetValue returns false if the request isn't being served by a Router.
+func SetValue(req *http.Request, key, value interface{}) bool {
+	rc, ok := req.Context().Value(requestContextKey{}).(*requestContext)
+	if !ok {
+		return false
+	}
+	rc.mu.Lock()
+	if rc.values == nil {
+		rc.values = map[interface{}]interface{}{}
+	}
+	rc.values[key] = value
+	rc.mu.Unlock()
+	return true
+}
+
+// Timeout sets a deadline on the Context of requests for the routes at
+// or beneath the SubRoute, including the Fallback handler. Controllers
+// should stop work when Ctx().Done() is closed; a Result returned after
+// the deadline is replaced with a 503 Service Unavailable response.
+func (sr *SubRoute) Timeout(d time.Duration) {
+	sr.local.edit(func() {
+		sr.local.Timeout = d
+	})
+}
+
+// timeout returns the Timeout of the closest Branch with one set.
+func (b *Branch) timeout() time.Duration {
+	for current := b; current != nil; current = current.Parent {
+		if current.Timeout != 0 {
+			return current.Timeout
+		}
+	}
+	return 0
+}
+
+// withTimeout adds the timeout for b to the Context of req.
+func withTimeout(b *Branch, req *http.Request) (*http.Request, context.CancelFunc) {
+	if d := b.timeout(); d > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), d)
+		return req.WithContext(ctx), cancel
+	}
+	return req, func() {}
+}
+
+// Ctx returns the Context of the request.
+func (bc BaseController) Ctx() context.Context {
+	if bc.Request == nil {
+		return context.Background()
+	}
+	return bc.Request.Context()
+}
+
+// Value returns a value from the Context of the request.
+func (bc BaseController) Value(key interface{}) interface{} {
+	return bc.Ctx().Value(key)
+}
+
+// SetValue stores a value in the Context of the request, see SetValue.
+func (bc *BaseController) SetValue(key, value interface{}) {
+	if bc.Request == nil {
+		bc.Request = (&http.Request{}).WithContext(context.Background())
+	}
+	if !SetValue(bc.Request, key, value) {
+		bc.Request = bc.Request.WithContext(context.WithValue(bc.Request.Context(), key, value))
+	}
+}
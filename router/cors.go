@@ -0,0 +1,174 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// CORSPolicy describes which cross-origin requests are allowed for the
+// routes of a Router or SubRoute. Preflight requests are answered by the
+// Router using the methods routed at the requested path, and responses
+// to allowed origins are decorated with the CORS headers.
+type CORSPolicy struct {
+	// AllowedOrigins may contain exact origins, "*" for any origin, or
+	// patterns like "https://*.example.com"
+	AllowedOrigins []string
+	// AllowOrigin is checked when an origin doesn't match AllowedOrigins
+	AllowOrigin func(origin string) bool
+	// AllowedMethods defaults to the methods routed at the path
+	AllowedMethods []string
+	// AllowedHeaders may contain "*" to allow any requested header
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// CORS sets the CORSPolicy for every route in the Router, SubRoutes may
+// set their own policy which will be used instead.
+func (r *Router) CORS(p CORSPolicy) {
+	r.Tree.Branch.edit(func() {
+		r.Tree.Branch.CORS = &p
+	})
+}
+
+// CORS sets the CORSPolicy for the routes at or beneath the SubRoute.
+func (sr *SubRoute) CORS(p CORSPolicy) {
+	sr.local.edit(func() {
+		sr.local.CORS = &p
+	})
+}
+
+// corsPolicy returns the policy of the closest Branch with one set.
+func (b *Branch) corsPolicy() *CORSPolicy {
+	for current := b; current != nil; current = current.Parent {
+		if current.CORS != nil {
+			return current.CORS
+		}
+	}
+	return nil
+}
+
+func isPreflight(req *http.Request) bool {
+	return req.Method == "OPTIONS" &&
+		req.Header.Get("Origin") != "" &&
+		req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+func (p *CORSPolicy) originAllowed(origin string) bool {
+	for _, allowed := range p.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		if ok, _ := path.Match(allowed, origin); ok {
+			return true
+		}
+	}
+	return p.AllowOrigin != nil && p.AllowOrigin(origin)
+}
+
+// decorate sets the headers for a non-preflight request, returning false
+// if the request had no Origin or the Origin isn't allowed.
+func (p *CORSPolicy) decorate(w http.ResponseWriter, req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	addVary(w, "Origin")
+	if !p.originAllowed(origin) {
+		return false
+	}
+
+	if contains(p.AllowedOrigins, "*") && !p.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(p.ExposedHeaders) > 0 {
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(p.ExposedHeaders, ", "))
+	}
+	return true
+}
+
+// preflight answers a preflight request, routed lists the methods that
+// have routes at the requested path.
+func (p *CORSPolicy) preflight(w http.ResponseWriter, req *http.Request, routed []string) {
+	addVary(w, "Access-Control-Request-Method")
+	addVary(w, "Access-Control-Request-Headers")
+	defer w.WriteHeader(http.StatusNoContent)
+	if !p.decorate(w, req) {
+		return
+	}
+	w.Header().Del("Access-Control-Expose-Headers")
+
+	method := strings.ToUpper(req.Header.Get("Access-Control-Request-Method"))
+	methods := p.AllowedMethods
+	if len(methods) == 0 {
+		methods = []string{}
+		for _, m := range routed {
+			if !contains(methods, m) {
+				methods = append(methods, m)
+			}
+		}
+		if contains(methods, "GET") && !contains(methods, "HEAD") {
+			methods = append(methods, "HEAD")
+		}
+	}
+	if !contains(methods, method) && !contains(methods, "*") {
+		w.Header().Del("Access-Control-Allow-Origin")
+		w.Header().Del("Access-Control-Allow-Credentials")
+		return
+	}
+
+	requested := []string{}
+	for _, h := range strings.Split(req.Header.Get("Access-Control-Request-Headers"), ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			requested = append(requested, http.CanonicalHeaderKey(h))
+		}
+	}
+	if !contains(p.AllowedHeaders, "*") {
+		for _, h := range requested {
+			if !p.headerAllowed(h) {
+				w.Header().Del("Access-Control-Allow-Origin")
+				w.Header().Del("Access-Control-Allow-Credentials")
+				return
+			}
+		}
+	}
+
+	if contains(methods, "*") {
+		w.Header().Set("Access-Control-Allow-Methods", method)
+	} else {
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	}
+	if len(requested) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+	}
+	if p.MaxAge != 0 {
+		w.Header().Set("Access-Control-Max-Age", fmt.Sprintf("%.f", p.MaxAge.Seconds()))
+	}
+}
+
+func (p *CORSPolicy) headerAllowed(header string) bool {
+	for _, allowed := range p.AllowedHeaders {
+		if http.CanonicalHeaderKey(allowed) == header {
+			return true
+		}
+	}
+	return false
+}
+
+func addVary(w http.ResponseWriter, header string) {
+	for _, v := range w.Header()["Vary"] {
+		if v == header {
+			return
+		}
+	}
+	w.Header().Add("Vary", header)
+}
@@ -4,8 +4,11 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"reflect"
+	"regexp"
 	"strconv"
+	"strings"
 
 	"golang.org/x/net/websocket"
 )
@@ -28,20 +31,57 @@ func (re RedirectError) Redirect(w http.ResponseWriter, r *http.Request) {
 	}
 	http.Redirect(w, r, re.Location, re.Code)
 }
+
+func (RedirectError) SetRequest(*http.Request) {
+}
+
+// Execute is only used when a RedirectError is executed outside of a
+// Router, the Router redirects using Redirect.
+func (re RedirectError) Execute(w http.ResponseWriter) {
+	if re.Code == 0 {
+		re.Code = 302
+	}
+	w.Header().Set("Location", re.Location)
+	w.WriteHeader(re.Code)
+}
+
+func (re RedirectError) String() string {
+	return re.Error()
+}
 func ctrlName(ctrl interface{}) string {
+	if ctrl == nil {
+		return ""
+	}
 	if adc, ok := ctrl.(autoDupeCtrl); ok {
 		return adc.Name()
 	}
 	return reflect.TypeOf(ctrl).Name()
 }
 
-func callCtrl(w http.ResponseWriter, r *http.Request, l Leaf, p map[string]string, lg *log.Logger) (Controller, Result) {
+func callCtrl(rt *Router, w http.ResponseWriter, r *http.Request, l Leaf, p map[string]string, suffix string, lg *log.Logger) (Controller, Result) {
 	ctrl := l.Ctrl.Dupe()
+	if err := rt.inject(ctrl, r, false); err != nil {
+		return ctrl, InternalError{err}
+	}
 	ctrl.SetRequestData(w, r)
 	ctrl.SetID(p)
 	ctrl.SetLogger(lg)
+	if rs, ok := ctrl.(routerSetter); ok {
+		rs.SetRouter(rt)
+	}
+	if fs, ok := ctrl.(formatSetter); ok {
+		fs.SetFormat(requestFormat(r, l, suffix))
+	}
+	if fs, ok := ctrl.(formatSuffixSetter); ok {
+		fs.setFormatSuffix(suffix != "")
+	}
 	name := ctrlName(ctrl)
 	lg.Printf("Starting request for %s using %s.%s\n", r.URL.String(), name, l.Action)
+	if l.SetCache {
+		if c, ok := ctrl.(cacher); ok {
+			c.SetCache(rt.Cache)
+		}
+	}
 	if l.SetContext {
 		if sc, ok := ctrl.(contexter); ok {
 			sc.SetContext(map[string]interface{}{})
@@ -53,7 +93,7 @@ func callCtrl(w http.ResponseWriter, r *http.Request, l Leaf, p map[string]strin
 			res := pf.PreFilter()
 			if res != nil {
 				lg.Printf("PreFilter returned %s\n", res.String())
-				return nil, res
+				return ctrl, res
 			}
 		}
 	}
@@ -63,10 +103,13 @@ func callCtrl(w http.ResponseWriter, r *http.Request, l Leaf, p map[string]strin
 			res := pi.PreItem()
 			if res != nil {
 				lg.Printf("PreItem returned %s\n", res.String())
-				return nil, res
+				return ctrl, res
 			}
 		}
 	}
+	if err := rt.inject(ctrl, r, true); err != nil {
+		return ctrl, InternalError{err}
+	}
 
 	return ctrl, nil
 }
@@ -75,12 +118,18 @@ type BaseController struct {
 	http.ResponseWriter `dupe:"no"`
 	Request             *http.Request `dupe:"no"`
 	Log                 *log.Logger   `dupe:"no"`
+	// The Router that dispatched the request
+	Router *Router `dupe:"no"`
 	// The Cache is shared between all Controllers
-	Cache map[string]interface{}
+	Cache *Cache `dupe:"no"`
 	// The Context will be a new map each request
 	Context map[string]interface{}
 	// URL Params
 	ID map[string]string
+	// The format from the format suffix or Accept header, like "json"
+	Format string
+
+	formatSuffix bool
 }
 
 func (bc *BaseController) SetRequestData(w http.ResponseWriter, r *http.Request) {
@@ -92,7 +141,19 @@ func (bc *BaseController) SetLogger(l *log.Logger) {
 	bc.Log = l
 }
 
-func (bc *BaseController) SetCache(c map[string]interface{}) {
+func (bc *BaseController) SetRouter(r *Router) {
+	bc.Router = r
+}
+
+func (bc *BaseController) SetFormat(f string) {
+	bc.Format = f
+}
+
+func (bc *BaseController) setFormatSuffix(suffix bool) {
+	bc.formatSuffix = suffix
+}
+
+func (bc *BaseController) SetCache(c *Cache) {
 	bc.Cache = c
 }
 
@@ -113,6 +174,42 @@ func (bc BaseController) IntID(name string) (int, bool) {
 	return iv, err == nil
 }
 
+// Int64ID returns the param as an int64, for IDs too large for an int.
+func (bc BaseController) Int64ID(name string) (int64, bool) {
+	sv, ok := bc.ID[name]
+	if !ok {
+		return 0, false
+	}
+	iv, err := strconv.ParseInt(sv, 10, 64)
+	return iv, err == nil
+}
+
+// StringID returns the param, it returns false if it is missing or empty.
+func (bc BaseController) StringID(name string) (string, bool) {
+	sv, ok := bc.ID[name]
+	return sv, ok && sv != ""
+}
+
+var uuidPattern = regexp.MustCompile("^" + Constraints["uuid"] + "$")
+
+// UUIDID returns the param if it is a UUID, in lower case.
+func (bc BaseController) UUIDID(name string) (string, bool) {
+	sv, ok := bc.ID[name]
+	if !ok || !uuidPattern.MatchString(sv) {
+		return "", false
+	}
+	return strings.ToLower(sv), true
+}
+
+// URLFor builds the path for a named route using the Router that
+// dispatched the current request. See Router.URLFor.
+func (bc BaseController) URLFor(name string, params map[string]string, query url.Values) (string, error) {
+	if bc.Router == nil {
+		return "", fmt.Errorf("No Router set for controller")
+	}
+	return bc.Router.URLFor(name, params, query)
+}
+
 type Controller interface {
 	Path() string
 	SetRequestData(http.ResponseWriter, *http.Request)
@@ -168,77 +265,6 @@ func wshandler(wf WSHandlerFunc) func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-type autoDupeCtrl struct {
-	Controller
-}
-
-func (adc autoDupeCtrl) Name() string {
-	return reflect.TypeOf(adc.Controller).Name()
-}
-func (adc autoDupeCtrl) Dupe() Controller {
-	rs := reflect.ValueOf(adc.Controller)
-	rt := reflect.TypeOf(adc.Controller)
-	rn := reflect.New(rt)
-	for i := 0; i < rt.NumField(); i++ {
-		switch rn.Elem().Field(i).Kind() {
-		case reflect.Struct:
-			if rt.Field(i).Tag.Get("dupe") != "no" {
-				reflectDupe(rs.Field(i), rn.Elem().Field(i).Addr())
-			} else {
-				rn.Elem().Field(i).Set(rs.Field(i))
-			}
-		case reflect.Ptr:
-			if rt.Field(i).Type.Elem().Kind() == reflect.Struct {
-				if rt.Field(i).Tag.Get("dupe") != "no" {
-					ov := reflect.New(rt.Field(i).Type.Elem())
-					reflectDupe(rs.Field(i).Elem(), ov)
-					rn.Elem().Field(i).Set(ov)
-				} else {
-					rn.Elem().Field(i).Set(rs.Field(i))
-				}
-			} else {
-				rn.Elem().Field(i).Set(rs.Field(i))
-			}
-		default:
-			if rs.Field(i).IsValid() && rn.Elem().Field(i).CanSet() {
-				rn.Elem().Field(i).Set(rs.Field(i))
-			}
-		}
-	}
-	return rn.Interface().(Controller)
-}
-
-func reflectDupe(sv, ov reflect.Value) {
-	if !sv.IsValid() {
-		return
-	}
-	rt := sv.Type()
-	for i := 0; i < rt.NumField(); i++ {
-		switch sv.Field(i).Kind() {
-		case reflect.Struct:
-			if rt.Field(i).Tag.Get("dupe") != "no" {
-				reflectDupe(sv.Field(i), ov.Elem().Field(i).Addr())
-			} else {
-				ov.Elem().Field(i).Set(sv.Field(i))
-			}
-		case reflect.Ptr:
-			if rt.Field(i).Type.Elem().Kind() == reflect.Struct {
-				if rt.Field(i).Tag.Get("dupe") != "no" {
-					oov := reflect.New(rt.Field(i).Type.Elem())
-					reflectDupe(sv.Field(i).Elem(), oov)
-					ov.Elem().Field(i).Set(oov)
-				} else {
-					ov.Elem().Field(i).Set(sv.Field(i))
-				}
-			} else {
-				ov.Elem().Field(i).Set(sv.Field(i))
-			}
-		default:
-			ov.Elem().Field(i).Set(sv.Field(i))
-		}
-	}
-}
-
 // RestfulController lists all the possible functions
 // that may be implemented by controllers, note that you
 // should implement a subset of the functions as needed.
@@ -262,6 +288,8 @@ type RestfulController interface {
 	Create() Result
 	Index() Result
 	WSBase(*websocket.Conn)
+	// Constraint for the item ID, like "int" or "[a-z-]+"
+	IDConstraint() string
 
 	// Extra Action Defintion functions
 	OtherBase(*SubRoute)
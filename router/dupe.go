@@ -0,0 +1,349 @@
+package router
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// autoDupeCtrl duplicates controllers that don't have a Dupe method.
+//
+// The controller, which may be a struct or a pointer to a struct, is
+// copied and then its fields are duplicated depending on their dupe tag:
+//
+//	no    the field is shared with the original controller
+//	deep  maps, slices, arrays and pointers are copied recursively
+//	zero  the field is set to its zero value for each request
+//
+// Without a tag, structs and pointers to structs are duplicated the same
+// way and anything else is shared. Nil pointers stay nil, except for
+// embedded pointers like *BaseController which are set to a new zero
+// struct, and pointers that lead back to a struct that was already copied
+// point to its copy. Unexported fields are always shared, CheckDupe
+// reports unexported fields that may need to be copied.
+type autoDupeCtrl struct {
+	Controller
+}
+
+func (adc autoDupeCtrl) Name() string {
+	t := reflect.TypeOf(adc.Controller)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+func (adc autoDupeCtrl) Dupe() Controller {
+	rv := reflect.ValueOf(adc.Controller)
+	t := rv.Type()
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+		rv = rv.Elem()
+	}
+	rn := reflect.New(t)
+	if rv.IsValid() {
+		rn.Elem().Set(rv)
+	}
+	dupePlanFor(t).apply(rn.Elem(), nil)
+	return rn.Interface().(Controller)
+}
+
+// CheckDupe reports problems with duplicating a controller that doesn't
+// have a Dupe method, like dupe tags that can't be used or unexported
+// fields that will be shared between requests. The Router records these
+// problems as InvalidDupe conflicts when the controller is added.
+func CheckDupe(ctrl Controller) error {
+	if _, ok := ctrl.(DupableController); ok {
+		return nil
+	}
+	rv := reflect.ValueOf(ctrl)
+	if !rv.IsValid() {
+		return &DupeError{Problems: []string{"controller is nil"}}
+	}
+	t := rv.Type()
+	de := &DupeError{Type: t.String()}
+	if t.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			de.Problems = append(de.Problems, "controller is a nil pointer")
+		}
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		de.Problems = append(de.Problems, "controller is not a struct or a pointer to a struct")
+		return de
+	}
+	checkDupeFields(t, t.Name(), true, map[reflect.Type]bool{}, de)
+	if len(de.Problems) > 0 {
+		return de
+	}
+	return nil
+}
+
+// DupeError lists the problems CheckDupe found with a controller.
+type DupeError struct {
+	Type     string
+	Problems []string
+}
+
+func (de *DupeError) Error() string {
+	return fmt.Sprintf("Cannot duplicate %s: %s", de.Type, strings.Join(de.Problems, "; "))
+}
+
+// checkDupeFields checks the fields of a struct that will be duplicated,
+// own is set for the controller and the structs embedded in it, where
+// shared unexported fields are reported.
+func checkDupeFields(t reflect.Type, path string, own bool, seen map[reflect.Type]bool, de *DupeError) {
+	if seen[t] {
+		return
+	}
+	seen[t] = true
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := path + "." + f.Name
+		tag, tagged := f.Tag.Lookup("dupe")
+		switch tag {
+		case "no":
+			continue
+		case "deep", "zero":
+			if f.PkgPath != "" {
+				de.Problems = append(de.Problems, fmt.Sprintf("unexported field %s can't be tagged dupe:%q", name, tag))
+			} else if tag == "deep" && !deepKind(f.Type.Kind()) {
+				de.Problems = append(de.Problems, fmt.Sprintf("field %s is a %s, dupe:\"deep\" is for maps, slices, arrays, pointers and structs", name, f.Type.Kind()))
+			}
+			continue
+		default:
+			if tagged {
+				de.Problems = append(de.Problems, fmt.Sprintf("field %s has an unknown dupe tag %q", name, tag))
+				continue
+			}
+		}
+
+		ft := f.Type
+		if !dupeSettable(f) {
+			if own && (ft.Kind() == reflect.Map || ft.Kind() == reflect.Slice ||
+				(ft.Kind() == reflect.Ptr && ft.Elem().Kind() == reflect.Struct)) {
+				de.Problems = append(de.Problems, fmt.Sprintf("unexported field %s will be shared between requests, tag it dupe:\"no\" or export it", name))
+			}
+			continue
+		}
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct {
+			checkDupeFields(ft, name, own && f.Anonymous, seen, de)
+		}
+	}
+}
+
+// dupeSettable reports whether the field can be replaced when duplicating
+// a struct, the fields of embedded structs can be even when the struct
+// type is unexported.
+func dupeSettable(f reflect.StructField) bool {
+	return f.PkgPath == "" || (f.Anonymous && f.Type.Kind() == reflect.Struct)
+}
+
+func deepKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Ptr, reflect.Struct:
+		return true
+	}
+	return false
+}
+
+// dupePlan lists the fields of a struct type that need more than a copy
+// of the struct to be duplicated, plans are built once for each type.
+type dupePlan struct {
+	fields []dupeField
+	// cyclic is set when the type can reach a type that points back to
+	// itself, copies of these types track the pointers they have copied
+	cyclic bool
+	done   bool
+}
+
+type dupeOp int
+
+const (
+	dupeStruct dupeOp = iota
+	dupePtr
+	dupeDeep
+	dupeZero
+)
+
+// dupeKey identifies a copied pointer, the type is needed since a struct
+// and its first field have the same address.
+type dupeKey struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+type dupeField struct {
+	index    int
+	op       dupeOp
+	plan     *dupePlan
+	embedded bool
+}
+
+var (
+	dupePlans   sync.Map
+	dupePlansMu sync.Mutex
+)
+
+func dupePlanFor(t reflect.Type) *dupePlan {
+	if p, ok := dupePlans.Load(t); ok {
+		return p.(*dupePlan)
+	}
+	dupePlansMu.Lock()
+	defer dupePlansMu.Unlock()
+	building := map[reflect.Type]*dupePlan{}
+	p := buildDupePlan(t, building)
+	// a type that leads into a cycle has to track pointers from the
+	// start, even when the cycle was found while building another type
+	for changed := true; changed; {
+		changed = false
+		for _, bp := range building {
+			for _, f := range bp.fields {
+				if !bp.cyclic && f.plan != nil && f.plan.cyclic {
+					bp.cyclic, changed = true, true
+				}
+			}
+		}
+	}
+	for bt, bp := range building {
+		dupePlans.Store(bt, bp)
+	}
+	return p
+}
+
+func buildDupePlan(t reflect.Type, building map[reflect.Type]*dupePlan) *dupePlan {
+	if p, ok := dupePlans.Load(t); ok {
+		return p.(*dupePlan)
+	}
+	if p, ok := building[t]; ok {
+		if !p.done {
+			p.cyclic = true
+		}
+		return p
+	}
+	p := &dupePlan{}
+	building[t] = p
+	if t.Kind() != reflect.Struct {
+		p.done = true
+		return p
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !dupeSettable(f) {
+			continue
+		}
+		exported := f.PkgPath == ""
+		switch tag := f.Tag.Get("dupe"); {
+		case tag == "no":
+		case tag == "zero" && exported:
+			p.fields = append(p.fields, dupeField{index: i, op: dupeZero})
+		case tag == "deep" && exported && deepKind(f.Type.Kind()):
+			p.fields = append(p.fields, dupeField{index: i, op: dupeDeep})
+		case f.Type.Kind() == reflect.Struct:
+			if sub := buildDupePlan(f.Type, building); len(sub.fields) > 0 {
+				p.fields = append(p.fields, dupeField{index: i, op: dupeStruct, plan: sub})
+			}
+		case f.Type.Kind() == reflect.Ptr && f.Type.Elem().Kind() == reflect.Struct:
+			p.fields = append(p.fields, dupeField{index: i, op: dupePtr, plan: buildDupePlan(f.Type.Elem(), building), embedded: f.Anonymous})
+		}
+	}
+	p.done = true
+	return p
+}
+
+// apply duplicates the fields of v, which already holds a copy of the
+// original struct. seen maps the pointers copied so far to their copies,
+// it is only needed once a cyclic type is reached.
+func (p *dupePlan) apply(v reflect.Value, seen map[dupeKey]reflect.Value) {
+	for _, f := range p.fields {
+		fv := v.Field(f.index)
+		switch f.op {
+		case dupeStruct:
+			f.plan.apply(fv, seen)
+		case dupePtr:
+			if fv.IsNil() {
+				if f.embedded {
+					fv.Set(reflect.New(fv.Type().Elem()))
+				}
+				continue
+			}
+			if seen == nil && f.plan.cyclic {
+				seen = map[dupeKey]reflect.Value{}
+			}
+			if c, ok := seen[dupeKey{fv.Pointer(), fv.Type()}]; ok {
+				fv.Set(c)
+				continue
+			}
+			nv := reflect.New(fv.Type().Elem())
+			nv.Elem().Set(fv.Elem())
+			if seen != nil {
+				seen[dupeKey{fv.Pointer(), fv.Type()}] = nv
+			}
+			f.plan.apply(nv.Elem(), seen)
+			fv.Set(nv)
+		case dupeDeep:
+			fv.Set(deepCopy(fv, map[dupeKey]reflect.Value{}))
+		case dupeZero:
+			fv.Set(reflect.Zero(fv.Type()))
+		}
+	}
+}
+
+// deepCopy copies maps, slices, arrays, pointers and the exported fields
+// of structs recursively, fields tagged dupe:"no" are shared. Pointers
+// that were already copied are looked up in seen.
+func deepCopy(v reflect.Value, seen map[dupeKey]reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		nv := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			nv.SetMapIndex(iter.Key(), deepCopy(iter.Value(), seen))
+		}
+		return nv
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		nv := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			nv.Index(i).Set(deepCopy(v.Index(i), seen))
+		}
+		return nv
+	case reflect.Array:
+		nv := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			nv.Index(i).Set(deepCopy(v.Index(i), seen))
+		}
+		return nv
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		if c, ok := seen[dupeKey{v.Pointer(), v.Type()}]; ok {
+			return c
+		}
+		nv := reflect.New(v.Type().Elem())
+		seen[dupeKey{v.Pointer(), v.Type()}] = nv
+		nv.Elem().Set(deepCopy(v.Elem(), seen))
+		return nv
+	case reflect.Struct:
+		nv := reflect.New(v.Type()).Elem()
+		nv.Set(v)
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).PkgPath == "" && t.Field(i).Tag.Get("dupe") != "no" {
+				nv.Field(i).Set(deepCopy(v.Field(i), seen))
+			}
+		}
+		return nv
+	}
+	return v
+}
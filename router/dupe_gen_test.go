@@ -0,0 +1,19 @@
+// Code generated by platform-dupe. DO NOT EDIT.
+
+package router
+
+// Dupe returns a copy of the genDupeCtrl for a request.
+func (c genDupeCtrl) Dupe() Controller {
+	d := c
+	if c.BaseController != nil {
+		v := *c.BaseController
+		d.BaseController = &v
+	} else {
+		d.BaseController = new(BaseController)
+	}
+	if c.Current != nil {
+		v := *c.Current
+		d.Current = &v
+	}
+	return &d
+}
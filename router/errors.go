@@ -0,0 +1,115 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+)
+
+// PanicError is passed to the error handling when a controller panics.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (pe PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", pe.Value)
+}
+
+// resultError returns the error carried by an InternalError or
+// RedirectError Result.
+func resultError(res Result) (error, bool) {
+	switch er := res.(type) {
+	case InternalError:
+		return er.Error, true
+	case *InternalError:
+		return er.Error, true
+	case RedirectError:
+		return er, true
+	case *RedirectError:
+		return *er, true
+	case *decorated:
+		return resultError(er.Result)
+	}
+	return nil, false
+}
+
+// handleError passes err to OnError if it is set. Otherwise, a
+// RedirectError redirects, and any other error is rendered as a 500
+// error, with a detailed page when the Router is in Development mode.
+func (r *Router) handleError(err error, w http.ResponseWriter, req *http.Request, ctrl Controller, leaf Leaf, id map[string]string, logBuffer *bytes.Buffer) {
+	if r.OnError != nil {
+		r.OnError(err, w, req, ctrl)
+		return
+	}
+	if re, ok := err.(RedirectError); ok {
+		re.Redirect(w, req)
+		return
+	}
+	if !r.Development {
+		InternalError{err}.Execute(w)
+		return
+	}
+
+	ep := errorPage{
+		Error:  err.Error(),
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Ctrl:   ctrlName(leaf.Ctrl),
+		Action: leaf.Action,
+		Path:   leaf.Path,
+	}
+	for k, v := range id {
+		ep.ID = append(ep.ID, [2]string{k, v})
+	}
+	sort.Slice(ep.ID, func(i, j int) bool { return ep.ID[i][0] < ep.ID[j][0] })
+	if logBuffer != nil {
+		ep.Log = logBuffer.String()
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
+	errorTemplate.Execute(w, ep)
+}
+
+type errorPage struct {
+	Error        string
+	Method, URL  string
+	Ctrl, Action string
+	Path         string
+	ID           [][2]string
+	Log          string
+}
+
+var errorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Internal Server Error</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+pre { background: #f4f4f4; padding: 1em; overflow: auto; }
+th { text-align: left; padding-right: 1em; }
+</style>
+</head>
+<body>
+<h1>Internal Server Error</h1>
+<pre>{{.Error}}</pre>
+<h2>Request</h2>
+<table>
+<tr><th>Request</th><td>{{.Method}} {{.URL}}</td></tr>
+<tr><th>Controller</th><td>{{.Ctrl}}</td></tr>
+<tr><th>Action</th><td>{{.Action}}</td></tr>
+<tr><th>Route</th><td>{{.Path}}</td></tr>
+</table>
+<h2>ID</h2>
+<table>
+{{range .ID}}<tr><th>{{index . 0}}</th><td>{{index . 1}}</td></tr>
+{{else}}<tr><td>No ID params</td></tr>
+{{end}}</table>
+<h2>Request Log</h2>
+<pre>{{.Log}}</pre>
+</body>
+</html>
+`))
@@ -0,0 +1,168 @@
+package router
+
+import (
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MimeTypes maps the names of formats to the content types used to
+// negotiate them with the Accept header of a request.
+var MimeTypes = map[string]string{
+	"html": "text/html",
+	"json": "application/json",
+	"xml":  "application/xml",
+	"js":   "application/javascript",
+	"csv":  "text/csv",
+	"txt":  "text/plain",
+}
+
+// DefaultFormats are negotiated for routes that don't have Formats set,
+// earlier formats are preferred when the Accept header allows several.
+var DefaultFormats = []string{"html", "json", "xml", "js", "csv", "txt"}
+
+// Formats sets the formats that may be requested with a suffix like
+// /posts/1.json for every route in the Router, the first format is used
+// when the request doesn't have an Accept header.
+func (r *Router) Formats(formats ...string) {
+	r.Tree.Branch.edit(func() {
+		r.Tree.Branch.Formats = formats
+	})
+}
+
+// Formats sets the formats for the routes at or beneath the SubRoute.
+func (sr *SubRoute) Formats(formats ...string) {
+	sr.local.edit(func() {
+		sr.local.Formats = formats
+	})
+}
+
+// formats returns the Formats of the closest Branch with them set.
+func (b *Branch) formats() []string {
+	for current := b; current != nil; current = current.Parent {
+		if current.Formats != nil {
+			return current.Formats
+		}
+	}
+	return nil
+}
+
+// formatSuffix returns the format suffix of path and the path without
+// it, if the last segment of path has an extension.
+func formatSuffix(p string) (string, string, bool) {
+	ext := path.Ext(p)
+	if len(ext) < 2 || strings.HasSuffix(p[:len(p)-len(ext)], "/") {
+		return "", p, false
+	}
+	return ext[1:], p[:len(p)-len(ext)], true
+}
+
+// requestFormat picks the format for a request to a Leaf, the format
+// suffix is used if it was in the path, otherwise the Accept header is
+// negotiated against the Leaf's formats.
+func requestFormat(r *http.Request, l Leaf, suffix string) string {
+	if suffix != "" {
+		return suffix
+	}
+	formats := DefaultFormats
+	if l.branch != nil && l.branch.formats() != nil {
+		formats = l.branch.formats()
+	}
+	return negotiate(r.Header.Get("Accept"), formats)
+}
+
+// negotiate returns the format with the highest quality in accept,
+// earlier formats win ties. The first format is returned when accept is
+// empty, and an empty string when none of the formats are acceptable.
+func negotiate(accept string, formats []string) string {
+	if len(formats) == 0 {
+		return ""
+	}
+	if strings.TrimSpace(accept) == "" {
+		return formats[0]
+	}
+
+	type mediaRange struct {
+		mime string
+		q    float64
+	}
+	ranges := []mediaRange{}
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mr := mediaRange{mime: strings.ToLower(strings.TrimSpace(params[0])), q: 1}
+		for _, param := range params[1:] {
+			k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if k == "q" {
+				if q, err := strconv.ParseFloat(v, 64); err == nil {
+					mr.q = q
+				}
+			}
+		}
+		ranges = append(ranges, mr)
+	}
+
+	best, bestQ := "", 0.0
+	for _, format := range formats {
+		mime, ok := MimeTypes[format]
+		if !ok {
+			continue
+		}
+		// the most specific matching range sets the quality
+		q, specificity := 0.0, -1
+		for _, mr := range ranges {
+			s := -1
+			switch {
+			case mr.mime == mime:
+				s = 2
+			case strings.HasSuffix(mr.mime, "/*") && strings.HasPrefix(mime, mr.mime[:len(mr.mime)-1]):
+				s = 1
+			case mr.mime == "*/*" || mr.mime == "*":
+				s = 0
+			}
+			if s > specificity {
+				q, specificity = mr.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// RespondWith returns the Result for the format of the request. When a
+// format suffix was used it must be in responses, otherwise the Accept
+// header is negotiated against the formats in responses. A 406 Not
+// Acceptable response is returned when there isn't a suitable format.
+func (bc BaseController) RespondWith(responses map[string]func() Result) Result {
+	format := bc.Format
+	if _, ok := responses[format]; !ok && !bc.formatSuffix {
+		available := []string{}
+		for _, f := range DefaultFormats {
+			if _, ok := responses[f]; ok {
+				available = append(available, f)
+			}
+		}
+		extra := []string{}
+		for f := range responses {
+			if !contains(available, f) {
+				extra = append(extra, f)
+			}
+		}
+		sort.Strings(extra)
+		accept := ""
+		if bc.Request != nil {
+			accept = bc.Request.Header.Get("Accept")
+		}
+		format = negotiate(accept, append(available, extra...))
+	}
+	if f, ok := responses[format]; ok {
+		return f()
+	}
+	return Rendered{
+		Content: strings.NewReader("406 not acceptable"),
+		Status:  http.StatusNotAcceptable,
+	}
+}
@@ -0,0 +1,278 @@
+package router
+
+import (
+	"strings"
+	"sync"
+)
+
+// Freeze publishes the routes of the Router immediately, instead of when
+// the next request is served. ServeHTTP uses an immutable, compiled copy
+// of the RetrieveTree that avoids splitting the path and reuses the
+// storage for URL params, which is rebuilt after routes are changed.
+func (r *Router) Freeze() {
+	r.routes.publish(true)
+}
+
+// matcher is a compiled, read-only copy of a RetrieveTree.
+type matcher struct {
+	root  *node
+	hosts []*node
+}
+
+// node is a compiled Branch. Chains of static branches that only lead to
+// a single child are compressed into one node, with the segments after
+// the first one stored in extra.
+type node struct {
+	branch   *Branch
+	leaves   []Leaf
+	extra    []string
+	static   map[string]*node
+	dynamic  []*node
+	wildcard *node
+	fallback *Branch
+}
+
+type param struct {
+	name, value string
+}
+
+var paramPool = sync.Pool{
+	New: func() interface{} {
+		ps := make([]param, 0, 8)
+		return &ps
+	},
+}
+
+func compile(b *Branch) *matcher {
+	if b == nil {
+		b = &Branch{}
+	}
+	var fallback *Branch
+	for current := b; current != nil; current = current.Parent {
+		if current.Fallback != nil {
+			fallback = current
+			break
+		}
+	}
+	m := &matcher{root: compileNode(b, nil, fallback)}
+	for _, hb := range b.Hosts {
+		m.hosts = append(m.hosts, compileNode(hb, nil, fallback))
+	}
+	return m
+}
+
+func compileNode(b *Branch, extra []string, fallback *Branch) *node {
+	if b.Fallback != nil {
+		fallback = b
+	}
+	n := &node{
+		branch:   b,
+		leaves:   append([]Leaf(nil), b.Leaves...),
+		extra:    extra,
+		fallback: fallback,
+	}
+	if len(b.Static) > 0 {
+		n.static = make(map[string]*node, len(b.Static))
+		for seg, child := range b.Static {
+			chain := []string(nil)
+			for compressible(child) {
+				for next, grandchild := range child.Static {
+					chain = append(chain, next)
+					child = grandchild
+				}
+			}
+			n.static[seg] = compileNode(child, chain, fallback)
+		}
+	}
+	for _, child := range b.Dynamic {
+		n.dynamic = append(n.dynamic, compileNode(child, nil, fallback))
+	}
+	if b.Wildcard != nil {
+		n.wildcard = compileNode(b.Wildcard, nil, fallback)
+	}
+	return n
+}
+
+// compressible reports whether a static Branch only exists to lead to a
+// single static child.
+func compressible(b *Branch) bool {
+	return len(b.Leaves) == 0 && len(b.Static) == 1 &&
+		len(b.Dynamic) == 0 && b.Wildcard == nil && b.Fallback == nil
+}
+
+// nextSegment returns the first non-empty segment of path and the rest of
+// the path after it.
+func nextSegment(path string) (string, string) {
+	for len(path) > 0 && path[0] == '/' {
+		path = path[1:]
+	}
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		return path[:i], path[i:]
+	}
+	return path, ""
+}
+
+type nodeMatch struct {
+	node *node
+	id   map[string]string
+}
+
+// match is the compiled equivalent of RetrieveTree.RetrieveWithFallback
+// when limit is 2, or Retrieve when limit is 1.
+func (m *matcher) match(path string, limit int) Matches {
+	return m.matchHost("", path, limit)
+}
+
+// matchHost tries the routes for host first, using them if there are
+// leaves or a Fallback for the path in the host's routes.
+func (m *matcher) matchHost(host, path string, limit int) Matches {
+	ps := paramPool.Get().(*[]param)
+	defer func() {
+		*ps = (*ps)[:0]
+		paramPool.Put(ps)
+	}()
+
+	if host != "" {
+		host, port := requestHost(host)
+		for _, hn := range m.hosts {
+			if !matchHost(hn.branch.Host, host, port, ps) {
+				continue
+			}
+			r := hn.matchNode(path, ps, limit)
+			if len(r.Primary) > 0 || len(r.Secondary) > 0 ||
+				(r.fallbackBranch != nil && r.fallbackBranch.hostPattern() != "") {
+				return r
+			}
+			*ps = (*ps)[:0]
+		}
+	}
+	return m.root.matchNode(path, ps, limit)
+}
+
+func (n *node) matchNode(path string, ps *[]param, limit int) Matches {
+	var buf [2]nodeMatch
+	found := n.search(path, ps, buf[:0], limit)
+
+	r := Matches{}
+	fallback := n.fallback
+	if len(found) > 0 {
+		r.Primary, r.ID = found[0].node.leaves, found[0].id
+		fallback = found[0].node.fallback
+	} else {
+		r.ID = make(map[string]string, len(*ps))
+		for _, p := range *ps {
+			r.ID[p.name] = p.value
+		}
+		fallback = n.deepest(path).fallback
+	}
+	if len(found) > 1 {
+		r.Secondary, r.SecondaryID = found[1].node.leaves, found[1].id
+	}
+	if fallback != nil {
+		r.Fallback = fallback.Fallback
+		r.fallbackBranch = fallback
+	}
+	return r
+}
+
+func (n *node) search(path string, ps *[]param, found []nodeMatch, limit int) []nodeMatch {
+	if len(found) >= limit {
+		return found
+	}
+	seg, rest := nextSegment(path)
+	if seg == "" {
+		if len(n.leaves) > 0 {
+			id := make(map[string]string, len(*ps))
+			for _, p := range *ps {
+				id[p.name] = p.value
+			}
+			found = append(found, nodeMatch{n, id})
+		}
+		return found
+	}
+
+	if child, ok := n.static[seg]; ok {
+		if after, ok := child.consumeExtra(rest); ok {
+			found = child.search(after, ps, found, limit)
+		}
+	}
+	for _, child := range n.dynamic {
+		if len(found) >= limit {
+			return found
+		}
+		if child.branch.Constraint != nil && !child.branch.Constraint.MatchString(seg) {
+			continue
+		}
+		*ps = append(*ps, param{child.branch.Name, seg})
+		found = child.search(rest, ps, found, limit)
+		*ps = (*ps)[:len(*ps)-1]
+	}
+	if n.wildcard != nil && len(found) < limit && len(n.wildcard.leaves) > 0 {
+		if value, ok := wildcardPath(path); ok {
+			*ps = append(*ps, param{n.wildcard.branch.Name, value})
+			found = n.wildcard.search("", ps, found, limit)
+			*ps = (*ps)[:len(*ps)-1]
+		}
+	}
+	return found
+}
+
+// consumeExtra matches the compressed segments of a node against path.
+func (n *node) consumeExtra(path string) (string, bool) {
+	for _, e := range n.extra {
+		var seg string
+		seg, path = nextSegment(path)
+		if seg != e {
+			return "", false
+		}
+	}
+	return path, true
+}
+
+// wildcardPath is wildcardValue for an unsplit path, it only allocates
+// when the path has empty segments that need to be removed.
+func wildcardPath(path string) (string, bool) {
+	for rest := path; rest != ""; {
+		var seg string
+		seg, rest = nextSegment(rest)
+		if seg == "." || seg == ".." {
+			return "", false
+		}
+	}
+	path = strings.Trim(path, "/")
+	if strings.Contains(path, "//") {
+		return wildcardValue(strings.FieldsFunc(path, func(c rune) bool { return c == '/' }))
+	}
+	return path, true
+}
+
+func (n *node) deepest(path string) *node {
+	current := n
+	for {
+		seg, rest := nextSegment(path)
+		if seg == "" {
+			return current
+		}
+		if child, ok := current.static[seg]; ok {
+			if after, ok := child.consumeExtra(rest); ok {
+				current, path = child, after
+				continue
+			}
+			return current
+		}
+		next := (*node)(nil)
+		for _, child := range current.dynamic {
+			if child.branch.Constraint == nil || child.branch.Constraint.MatchString(seg) {
+				next = child
+				break
+			}
+		}
+		if next == nil {
+			if current.wildcard != nil {
+				return current.wildcard
+			}
+			return current
+		}
+		current, path = next, rest
+	}
+}
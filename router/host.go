@@ -0,0 +1,142 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Host returns a SubRoute for routes that only match requests for the
+// given host. Labels of the host starting with a colon, like the tenant
+// in ":tenant.example.com", match any value and are added to the ID of
+// the controller. A port, like "api.example.com:8080", only matches
+// requests for that port, hosts without a port match any port. Requests
+// for a host are routed with the routes of the Router when there aren't
+// any matching host routes.
+func (r *Router) Host(host string) *SubRoute {
+	host = strings.ToLower(host)
+	root := r.Tree.Branch
+	var br *Branch
+	root.edit(func() {
+		for _, hb := range root.Hosts {
+			if hb.Host == host {
+				br = hb
+				return
+			}
+		}
+		br = &Branch{Host: host, Parent: root}
+		// exact hosts are tried before hosts with params, and hosts with
+		// a port before hosts without one
+		i := len(root.Hosts)
+		for i > 0 && hostRank(root.Hosts[i-1].Host) > hostRank(host) {
+			i--
+		}
+		root.Hosts = append(root.Hosts, nil)
+		copy(root.Hosts[i+1:], root.Hosts[i:])
+		root.Hosts[i] = br
+	})
+	return &SubRoute{local: br}
+}
+
+// hostPattern returns the Host of the host Branch that b is beneath.
+func (b *Branch) hostPattern() string {
+	for current := b; current != nil; current = current.Parent {
+		if current.Host != "" {
+			return current.Host
+		}
+	}
+	return ""
+}
+
+// hostRank orders host patterns by the order they are tried in.
+func hostRank(pattern string) int {
+	rank := 0
+	name, port := splitHostPort(pattern)
+	if strings.HasPrefix(name, ":") || strings.Contains(name, ".:") {
+		rank += 2
+	}
+	if port == "" {
+		rank++
+	}
+	return rank
+}
+
+// splitHostPort splits a host pattern into the host and port, the port
+// is empty when the pattern doesn't have one.
+func splitHostPort(pattern string) (string, string) {
+	i := strings.LastIndexByte(pattern, ':')
+	if i <= 0 || pattern[i-1] == '.' || i == len(pattern)-1 {
+		return pattern, ""
+	}
+	for _, c := range pattern[i+1:] {
+		if c < '0' || c > '9' {
+			return pattern, ""
+		}
+	}
+	return pattern[:i], pattern[i+1:]
+}
+
+// requestHost splits the Host of a request into the host and port.
+func requestHost(host string) (string, string) {
+	port := ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	}
+	return strings.ToLower(host), port
+}
+
+// matchHost checks the host and port of a request against a host
+// pattern, adding the values for the labels with params to ps.
+func matchHost(pattern, host, port string, ps *[]param) bool {
+	pattern, patternPort := splitHostPort(pattern)
+	if patternPort != "" && patternPort != port {
+		return false
+	}
+	start := len(*ps)
+	for pattern != "" || host != "" {
+		var pl, hl string
+		pl, pattern = cutLabel(pattern)
+		hl, host = cutLabel(host)
+		switch {
+		case hl == "":
+			*ps = (*ps)[:start]
+			return false
+		case len(pl) > 1 && pl[0] == ':':
+			*ps = append(*ps, param{pl[1:], hl})
+		case pl != hl:
+			*ps = (*ps)[:start]
+			return false
+		}
+	}
+	return true
+}
+
+func cutLabel(host string) (string, string) {
+	if i := strings.IndexByte(host, '.'); i >= 0 {
+		return host[:i], host[i+1:]
+	}
+	return host, ""
+}
+
+// hostURL fills in the params of a host pattern, marking the params that
+// were used.
+func hostURL(pattern string, params map[string]string, used map[string]bool, name string) (string, error) {
+	pattern, port := splitHostPort(pattern)
+	labels := strings.Split(pattern, ".")
+	for i, label := range labels {
+		if len(label) < 2 || label[0] != ':' {
+			continue
+		}
+		v, ok := params[label[1:]]
+		if !ok {
+			return "", fmt.Errorf("Missing param '%s' for route '%s'", label[1:], name)
+		}
+		labels[i] = url.PathEscape(v)
+		used[label[1:]] = true
+	}
+	if port != "" {
+		return strings.Join(labels, ".") + ":" + port, nil
+	}
+	return strings.Join(labels, "."), nil
+}
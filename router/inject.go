@@ -0,0 +1,256 @@
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+)
+
+// injector holds the services given to Router.Provide and
+// Router.ProvideRequest.
+type injector struct {
+	mu        sync.RWMutex
+	providers []*provider
+}
+
+type provider struct {
+	name  string
+	typ   reflect.Type
+	value reflect.Value
+	// fn is set for request scoped providers
+	fn reflect.Value
+}
+
+var (
+	requestType = reflect.TypeOf((*http.Request)(nil))
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	cleanupType = reflect.TypeOf(func() {})
+)
+
+// Provide registers a service that is set on the fields of controllers
+// tagged with inject:"". Fields are matched by type, and a field with an
+// interface type may be set to any service implementing it. The same
+// service is given to every request.
+func (r *Router) Provide(svc interface{}) {
+	r.ProvideNamed("", svc)
+}
+
+// ProvideNamed registers a service for fields tagged inject:"name".
+func (r *Router) ProvideNamed(name string, svc interface{}) {
+	if svc == nil {
+		panic("router: Provide called with a nil service")
+	}
+	r.injector.add(&provider{name: name, typ: reflect.TypeOf(svc), value: reflect.ValueOf(svc)})
+}
+
+// ProvideRequest registers a function that creates a service for each
+// request, like a database transaction. The function must take an
+// *http.Request and return the service, optionally followed by a cleanup
+// func() and an error. It is called at most once per request, and the
+// cleanup functions run after the Result has been executed. Request
+// scoped services are set after PreFilter and PreItem have passed, so
+// they aren't created for requests that are redirected or declined.
+func (r *Router) ProvideRequest(fn interface{}) {
+	r.ProvideRequestNamed("", fn)
+}
+
+// ProvideRequestNamed registers a request scoped provider for fields
+// tagged inject:"name".
+func (r *Router) ProvideRequestNamed(name string, fn interface{}) {
+	fv := reflect.ValueOf(fn)
+	ft := fv.Type()
+	valid := ft.Kind() == reflect.Func && ft.NumIn() == 1 && ft.In(0) == requestType
+	if valid {
+		switch ft.NumOut() {
+		case 1:
+		case 2:
+			valid = ft.Out(1) == errorType || ft.Out(1) == cleanupType
+		case 3:
+			valid = ft.Out(1) == cleanupType && ft.Out(2) == errorType
+		default:
+			valid = false
+		}
+	}
+	if !valid {
+		panic(fmt.Sprintf("router: ProvideRequest needs a func(*http.Request) (T[, func()][, error]), got %s", ft))
+	}
+	r.injector.add(&provider{name: name, typ: ft.Out(0), fn: fv})
+}
+
+func (inj *injector) add(p *provider) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+	inj.providers = append(inj.providers, p)
+}
+
+// find returns the provider for a field, preferring a provider of the
+// exact type over one implementing an interface.
+func (inj *injector) find(name string, typ reflect.Type) *provider {
+	inj.mu.RLock()
+	defer inj.mu.RUnlock()
+	var found *provider
+	for _, p := range inj.providers {
+		if p.name != name {
+			continue
+		}
+		if p.typ == typ {
+			return p
+		}
+		if found == nil && typ.Kind() == reflect.Interface && p.typ.Implements(typ) {
+			found = p
+		}
+	}
+	return found
+}
+
+// scopedService is the result of calling a request scoped provider.
+type scopedService struct {
+	once  sync.Once
+	value reflect.Value
+	err   error
+}
+
+// get returns the service, calling request scoped providers once per
+// request. The provider is called without holding the lock on the
+// requestContext, so it may use SetValue or other services.
+func (p *provider) get(req *http.Request) (reflect.Value, error) {
+	if !p.fn.IsValid() {
+		return p.value, nil
+	}
+	rc, ok := req.Context().Value(requestContextKey{}).(*requestContext)
+	if !ok {
+		return reflect.Value{}, fmt.Errorf("Request scoped services need a request served by a Router")
+	}
+	rc.mu.Lock()
+	if rc.scoped == nil {
+		rc.scoped = map[*provider]*scopedService{}
+	}
+	ss, ok := rc.scoped[p]
+	if !ok {
+		ss = &scopedService{}
+		rc.scoped[p] = ss
+	}
+	rc.mu.Unlock()
+
+	ss.once.Do(func() {
+		out := p.fn.Call([]reflect.Value{reflect.ValueOf(req)})
+		if last := out[len(out)-1]; last.Type() == errorType && !last.IsNil() {
+			ss.err = last.Interface().(error)
+			return
+		}
+		if len(out) > 1 && out[1].Type() == cleanupType && !out[1].IsNil() {
+			rc.mu.Lock()
+			rc.cleanups = append(rc.cleanups, out[1].Interface().(func()))
+			rc.mu.Unlock()
+		}
+		ss.value = out[0]
+	})
+	return ss.value, ss.err
+}
+
+// injectField is a field tagged with inject, index leads to the field
+// through any embedded structs.
+type injectField struct {
+	index []int
+	name  string
+	path  string
+}
+
+var injectFieldCache sync.Map
+
+// injectFields finds the fields to inject for a controller type.
+func injectFields(t reflect.Type) ([]injectField, error) {
+	if cached, ok := injectFieldCache.Load(t); ok {
+		return cached.([]injectField), nil
+	}
+	fields := []injectField{}
+	if err := collectInjectFields(t, nil, t.Name(), map[reflect.Type]bool{}, &fields); err != nil {
+		return nil, err
+	}
+	injectFieldCache.Store(t, fields)
+	return fields, nil
+}
+
+func collectInjectFields(t reflect.Type, index []int, path string, seen map[reflect.Type]bool, fields *[]injectField) error {
+	if seen[t] {
+		return nil
+	}
+	seen[t] = true
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		fieldIndex := append(append([]int(nil), index...), i)
+		name, ok := f.Tag.Lookup("inject")
+		if ok {
+			if f.PkgPath != "" {
+				return fmt.Errorf("Cannot inject unexported field %s.%s", path, f.Name)
+			}
+			*fields = append(*fields, injectField{fieldIndex, name, path + "." + f.Name})
+			continue
+		}
+		if !f.Anonymous {
+			continue
+		}
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Struct {
+			if err := collectInjectFields(ft, fieldIndex, path+"."+ft.Name(), seen, fields); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// inject sets the tagged fields of a duplicated controller, either the
+// services given to Provide or the request scoped ones.
+func (r *Router) inject(ctrl Controller, req *http.Request, scoped bool) error {
+	v := reflect.ValueOf(ctrl)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	v = v.Elem()
+	fields, err := injectFields(v.Type())
+	if err != nil {
+		return err
+	}
+	for _, f := range fields {
+		fv, ok := fieldByIndex(v, f.index)
+		if !ok {
+			continue
+		}
+		if !fv.CanSet() {
+			return fmt.Errorf("Cannot inject %s, it is inside an unexported field", f.path)
+		}
+		p := r.injector.find(f.name, fv.Type())
+		if p == nil {
+			return fmt.Errorf("No service provided for %s (%s)", f.path, fv.Type())
+		}
+		if p.fn.IsValid() != scoped {
+			continue
+		}
+		svc, err := p.get(req)
+		if err != nil {
+			return err
+		}
+		fv.Set(svc)
+	}
+	return nil
+}
+
+// fieldByIndex is reflect.Value.FieldByIndex, but skips fields inside
+// nil embedded pointers.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
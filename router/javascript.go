@@ -0,0 +1,276 @@
+package router
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// JSFormat is the module style used by RouteListJS.
+type JSFormat int
+
+const (
+	// ESModule exports each route function with the export keyword
+	ESModule JSFormat = iota
+	// CommonJS assigns each route function to module.exports
+	CommonJS
+	// Global assigns each route function to a property of a global object
+	Global
+)
+
+// JSOptions controls the output of RouteListJS and ServeRouteListJS.
+type JSOptions struct {
+	Format JSFormat
+	// GlobalName is the name of the window object used by the Global
+	// format, defaults to "Routes"
+	GlobalName string
+	// Prefix is prepended to every generated path, useful when the
+	// Router is mounted under http.StripPrefix
+	Prefix string
+	// MaxAge sets the Cache-Control header for ServeRouteListJS
+	MaxAge time.Duration
+}
+
+type jsRoute struct {
+	Func   string
+	Params []string
+	Parts  []string
+	// names maps the params of the route to their arguments
+	names map[string]string
+}
+
+// RouteListJS writes a javascript module with one function per named
+// route, so show_posts_path becomes showPostsPath(posts, query). Each
+// function takes the dynamic segments of the route in order, followed
+// by an optional object of query parameters. Routes for a Host return
+// URLs starting with //host, their host params come first.
+func (r *Router) RouteListJS(w io.Writer, opts JSOptions) error {
+	routes := []jsRoute{}
+	seen := map[string]bool{}
+	for _, leaf := range r.published().ListLeaves() {
+		if leaf.Name == "" || seen[leaf.Name] {
+			continue
+		}
+		seen[leaf.Name] = true
+		routes = append(routes, newJSRoute(leaf, opts.Prefix))
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].Func < routes[j].Func
+	})
+
+	buf := &bytes.Buffer{}
+	io.WriteString(buf, "// Generated by platform/router, do not edit\n")
+	if opts.Format == Global {
+		name := opts.GlobalName
+		if name == "" {
+			name = "Routes"
+		}
+		fmt.Fprintf(buf, "(function(routes) {\n")
+		writeJSQuery(buf, "  ")
+		for _, route := range routes {
+			fmt.Fprintf(buf, "  routes.%s = %s;\n", route.Func, route.function())
+		}
+		fmt.Fprintf(buf, "})(window.%[1]s = window.%[1]s || {});\n", name)
+		_, err := io.Copy(w, buf)
+		return err
+	}
+
+	writeJSQuery(buf, "")
+	for _, route := range routes {
+		switch opts.Format {
+		case CommonJS:
+			fmt.Fprintf(buf, "module.exports.%s = %s;\n", route.Func, route.function())
+		default:
+			fmt.Fprintf(buf, "export const %s = %s;\n", route.Func, route.function())
+		}
+	}
+	_, err := io.Copy(w, buf)
+	return err
+}
+
+// ServeRouteListJS adds a GET endpoint at path that serves the output of
+// RouteListJS. The response has an ETag so clients can revalidate, and a
+// Cache-Control header when opts.MaxAge is set.
+func (r *Router) ServeRouteListJS(path string, opts JSOptions) {
+	sr := SubRoute{local: r.Tree.Branch}
+	sr.Get(path).HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		buf := &bytes.Buffer{}
+		if err := r.RouteListJS(buf, opts); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		etag := fmt.Sprintf(`"%x"`, sha1.Sum(buf.Bytes()))
+		w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+		w.Header().Set("ETag", etag)
+		if opts.MaxAge != 0 {
+			w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%.f", opts.MaxAge.Seconds()))
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		if req.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.Copy(w, buf)
+	})
+}
+
+func newJSRoute(leaf Leaf, prefix string) jsRoute {
+	route := jsRoute{Func: jsIdent(leaf.Name), names: map[string]string{}}
+	static := ""
+	// routes for a Host start with //host, like the URLs from Leaf.URL
+	if leaf.Host != "" {
+		host, port := splitHostPort(leaf.Host)
+		static = "//"
+		for i, label := range strings.Split(host, ".") {
+			if i > 0 {
+				static += "."
+			}
+			if len(label) > 1 && label[0] == ':' {
+				route.Parts = append(route.Parts, jsString(static))
+				route.Parts = append(route.Parts, "encodeURIComponent("+route.param(label[1:])+")")
+				static = ""
+			} else {
+				static += label
+			}
+		}
+		if port != "" {
+			static += ":" + port
+		}
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	static += prefix
+	root := prefix == ""
+	for _, split := range strings.Split(leaf.Path, "/") {
+		if split == "" {
+			continue
+		}
+		root = false
+		if name, ok := segmentParam(split); ok {
+			route.Parts = append(route.Parts, jsString(static+"/"))
+			if _, wild := wildcardParam(split); wild {
+				route.Parts = append(route.Parts, "encodeURIComponent("+route.param(name)+").replace(/%2F/g, \"/\")")
+			} else {
+				route.Parts = append(route.Parts, "encodeURIComponent("+route.param(name)+")")
+			}
+			static = ""
+		} else {
+			static += "/" + split
+		}
+	}
+	if root {
+		static += "/"
+	}
+	if static != "" {
+		route.Parts = append(route.Parts, jsString(static))
+	}
+	return route
+}
+
+// param returns the argument for a param of the route, adding it the
+// first time the param is used. Params used several times share one
+// argument, like the params of Leaf.URL.
+func (route *jsRoute) param(name string) string {
+	if arg, ok := route.names[name]; ok {
+		return arg
+	}
+	arg := jsIdent(name)
+	// the query argument and params that are the same identifier after
+	// conversion, like post_id and postId, get a number
+	taken := func(arg string) bool {
+		return arg == "query" || contains(route.Params, arg)
+	}
+	if taken(arg) {
+		i := 2
+		for taken(fmt.Sprint(arg, i)) {
+			i++
+		}
+		arg = fmt.Sprint(arg, i)
+	}
+	route.names[name] = arg
+	route.Params = append(route.Params, arg)
+	return arg
+}
+
+func (route jsRoute) function() string {
+	args := append(append([]string{}, route.Params...), "query")
+	return fmt.Sprintf(
+		"function(%s) { return %s + _query(query); }",
+		strings.Join(args, ", "),
+		strings.Join(route.Parts, " + "),
+	)
+}
+
+func writeJSQuery(w io.Writer, indent string) {
+	io.WriteString(w, indent+"function _query(query) {\n")
+	io.WriteString(w, indent+"  if (!query) { return \"\"; }\n")
+	io.WriteString(w, indent+"  var parts = [];\n")
+	io.WriteString(w, indent+"  for (var key in query) {\n")
+	io.WriteString(w, indent+"    if (Object.prototype.hasOwnProperty.call(query, key)) {\n")
+	io.WriteString(w, indent+"      parts.push(encodeURIComponent(key) + \"=\" + encodeURIComponent(query[key]));\n")
+	io.WriteString(w, indent+"    }\n")
+	io.WriteString(w, indent+"  }\n")
+	io.WriteString(w, indent+"  return parts.length ? \"?\" + parts.join(\"&\") : \"\";\n")
+	io.WriteString(w, indent+"}\n")
+}
+
+// jsReserved are the javascript reserved words, which can't be used as
+// function or argument names.
+var jsReserved = map[string]bool{
+	"await": true, "break": true, "case": true, "catch": true, "class": true,
+	"const": true, "continue": true, "debugger": true, "default": true,
+	"delete": true, "do": true, "else": true, "enum": true, "export": true,
+	"extends": true, "false": true, "finally": true, "for": true,
+	"function": true, "if": true, "implements": true, "import": true,
+	"in": true, "instanceof": true, "interface": true, "let": true,
+	"new": true, "null": true, "package": true, "private": true,
+	"protected": true, "public": true, "return": true, "static": true,
+	"super": true, "switch": true, "this": true, "throw": true, "true": true,
+	"try": true, "typeof": true, "var": true, "void": true, "while": true,
+	"with": true, "yield": true, "arguments": true, "eval": true,
+}
+
+// jsIdent converts a snake_case name into a camelCase javascript
+// identifier, dropping any characters that aren't allowed. Reserved words
+// get a _ suffix, so delete becomes delete_.
+func jsIdent(name string) string {
+	out := []rune{}
+	upper := false
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '$':
+			if upper && len(out) > 0 && c >= 'a' && c <= 'z' {
+				c += 'A' - 'a'
+			}
+			out = append(out, c)
+			upper = false
+		case c >= '0' && c <= '9':
+			if len(out) == 0 {
+				out = append(out, '_')
+			}
+			out = append(out, c)
+			upper = false
+		default:
+			upper = true
+		}
+	}
+	if len(out) == 0 {
+		return "_"
+	}
+	if jsReserved[string(out)] {
+		return string(out) + "_"
+	}
+	return string(out)
+}
+
+func jsString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
@@ -0,0 +1,188 @@
+package router
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// routes guards the RetrieveTree of a Router. Routes are added to the
+// tree while holding the lock, and ServeHTTP uses a copy of the tree that
+// is published after changes, so routes can be changed while the Router
+// is serving requests.
+type routes struct {
+	mu    sync.Mutex
+	root  *Branch
+	batch int
+	dirty int32
+	// current holds the published *routeTable
+	current atomic.Value
+}
+
+// routeTable is a published, read-only copy of the routes.
+type routeTable struct {
+	root    *Branch
+	matcher *matcher
+}
+
+func newRoutes(root *Branch) *routes {
+	rs := &routes{root: root, dirty: 1}
+	root.routes = rs
+	return rs
+}
+
+// table returns the published routes, publishing any changes made since
+// the last request.
+func (rs *routes) table() *routeTable {
+	if atomic.LoadInt32(&rs.dirty) == 1 {
+		rs.publish(false)
+	}
+	return rs.current.Load().(*routeTable)
+}
+
+// publish copies and compiles the routes. Changes aren't published while
+// a batch is in progress, unless nothing has been published yet.
+func (rs *routes) publish(force bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	published := rs.current.Load() != nil
+	if published && !force && (rs.batch > 0 || atomic.LoadInt32(&rs.dirty) == 0) {
+		return
+	}
+
+	root := rs.root.clone(nil)
+	rs.current.Store(&routeTable{root: root, matcher: compile(root)})
+	if rs.batch == 0 {
+		atomic.StoreInt32(&rs.dirty, 0)
+	}
+}
+
+// edit runs f while holding the lock for the tree that b belongs to, then
+// marks the tree as changed. Trees that don't belong to a Router aren't
+// locked.
+func (b *Branch) edit(f func()) {
+	rs := b.root().routes
+	if rs == nil {
+		f()
+		return
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	f()
+	atomic.StoreInt32(&rs.dirty, 1)
+}
+
+// view runs f while holding the lock for the tree that b belongs to.
+func (b *Branch) view(f func()) {
+	if rs := b.root().routes; rs != nil {
+		rs.mu.Lock()
+		defer rs.mu.Unlock()
+	}
+	f()
+}
+
+// published returns the routes currently used by ServeHTTP.
+func (r *Router) published() RetrieveTree {
+	return RetrieveTree{r.routes.table().root}
+}
+
+// clone copies the Branch and everything beneath it, the Leaves of the
+// copy belong to the copied branches.
+func (b *Branch) clone(parent *Branch) *Branch {
+	c := *b
+	c.Parent = parent
+	c.routes = nil
+	c.onConflict = nil
+	c.Conflicts = nil
+	c.Middleware = append([]func(http.Handler) http.Handler(nil), b.Middleware...)
+	c.Leaves = make([]Leaf, len(b.Leaves))
+	for i, leaf := range b.Leaves {
+		leaf.branch = &c
+		c.Leaves[i] = leaf
+	}
+	if b.Static != nil {
+		c.Static = make(map[string]*Branch, len(b.Static))
+		for seg, child := range b.Static {
+			c.Static[seg] = child.clone(&c)
+		}
+	}
+	c.Dynamic = nil
+	for _, child := range b.Dynamic {
+		c.Dynamic = append(c.Dynamic, child.clone(&c))
+	}
+	if b.Wildcard != nil {
+		c.Wildcard = b.Wildcard.clone(&c)
+	}
+	c.Hosts = nil
+	for _, child := range b.Hosts {
+		c.Hosts = append(c.Hosts, child.clone(&c))
+	}
+	return &c
+}
+
+// Remove removes every route with the given name from the Router,
+// reporting whether any routes were removed.
+func (r *Router) Remove(name string) bool {
+	removed := false
+	r.Tree.Branch.edit(func() {
+		br := []*Branch{r.Tree.Branch}
+		for len(br) > 0 {
+			brz := br[0]
+			br = br[1:]
+			leaves := brz.Leaves[:0:0]
+			for _, leaf := range brz.Leaves {
+				if leaf.Name == name {
+					removed = true
+				} else {
+					leaves = append(leaves, leaf)
+				}
+			}
+			brz.Leaves = leaves
+			br = append(br, brz.children()...)
+		}
+	})
+	return removed
+}
+
+// ModuleFunc allows a function to be used as a Module.
+type ModuleFunc func(*SubRoute)
+
+func (mf ModuleFunc) Load(sr *SubRoute) {
+	mf(sr)
+}
+
+// Replace removes the routes, Middleware, CORSPolicy, Formats, Timeout and
+// Fallback handler at and beneath the SubRoute, then loads m in their
+// place. Requests continue to use the previous routes until m has
+// finished loading. SubRoutes that were created beneath the SubRoute
+// before Replace, like the SubRoute returned by Many, are no longer part
+// of the Router, routes added to them are never served. Add routes beneath
+// the SubRoute passed to m instead.
+func (sr *SubRoute) Replace(m Module) {
+	rs := sr.local.root().routes
+	if rs != nil {
+		rs.mu.Lock()
+		rs.batch++
+		rs.mu.Unlock()
+		defer func() {
+			rs.mu.Lock()
+			rs.batch--
+			atomic.StoreInt32(&rs.dirty, 1)
+			rs.mu.Unlock()
+		}()
+	}
+
+	sr.local.edit(func() {
+		sr.local.Static = nil
+		sr.local.Dynamic = nil
+		sr.local.Wildcard = nil
+		sr.local.Leaves = nil
+		sr.local.Middleware = nil
+		sr.local.CORS = nil
+		sr.local.Formats = nil
+		sr.local.Timeout = 0
+		sr.local.Fallback = nil
+		sr.local.Conflicts = nil
+	})
+	m.Load(sr)
+}
@@ -1,10 +1,17 @@
 package router
 
 import (
+	"encoding/csv"
 	"encoding/json"
+	"encoding/xml"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 
 	"golang.org/x/net/websocket"
 )
@@ -18,12 +25,17 @@ type Result interface {
 type Rendered struct {
 	Content io.Reader
 	Status  int
+	// ContentType is sniffed from Content when it isn't set
+	ContentType string
 }
 
 func (Rendered) SetRequest(*http.Request) {
 }
 
 func (r Rendered) Execute(w http.ResponseWriter) {
+	if r.ContentType != "" {
+		setContentType(w, r.ContentType)
+	}
 	if r.Status != 0 {
 		w.WriteHeader(r.Status)
 	}
@@ -47,6 +59,7 @@ func (JSONData) SetRequest(*http.Request) {
 }
 
 func (r JSONData) Execute(w http.ResponseWriter) {
+	setContentType(w, "application/json; charset=utf-8")
 	if r.Status != 0 {
 		w.WriteHeader(r.Status)
 	}
@@ -71,13 +84,33 @@ func (r *JSONPData) SetRequest(req *http.Request) {
 	r.Request = req
 }
 
+// validCallback matches JSONP callbacks like cb or jQuery.callbacks_1.
+var validCallback = regexp.MustCompile(`^[a-zA-Z_$][0-9a-zA-Z_$]*(\.[a-zA-Z_$][0-9a-zA-Z_$]*)*$`)
+
+// Execute responds with JSON when there isn't a callback parameter, and
+// with a 400 Bad Request when the callback isn't a JavaScript identifier.
 func (r JSONPData) Execute(w http.ResponseWriter) {
+	callback := ""
+	if r.Request != nil {
+		callback = r.Request.URL.Query().Get("callback")
+	}
+	if callback == "" {
+		JSONData{Data: r.Data, Status: r.Status}.Execute(w)
+		return
+	}
+	if len(callback) > 128 || !validCallback.MatchString(callback) {
+		http.Error(w, "400 invalid callback", http.StatusBadRequest)
+		return
+	}
+
+	setContentType(w, "application/javascript; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 	if r.Status != 0 {
 		w.WriteHeader(r.Status)
 	}
-	io.WriteString(w, r.Request.URL.Query().Get("callback")+"(")
+	io.WriteString(w, "/**/"+callback+"(")
 	json.NewEncoder(w).Encode(r.Data)
-	io.WriteString(w, ")")
+	io.WriteString(w, ");")
 }
 
 func (r JSONPData) String() string {
@@ -92,6 +125,10 @@ type String struct {
 func (String) SetRequest(*http.Request) {
 }
 func (r String) Execute(w http.ResponseWriter) {
+	setContentType(w, "text/plain; charset=utf-8")
+	if r.Status != 0 {
+		w.WriteHeader(r.Status)
+	}
 	io.WriteString(w, r.Content)
 }
 
@@ -144,6 +181,7 @@ func (na NotAllowed) Execute(w http.ResponseWriter) {
 		}
 		http.Redirect(w, na.Request, na.Fallback, na.Status)
 	} else if na.Content != nil {
+		setContentType(w, "text/html; charset=utf-8")
 		if na.Status != 0 {
 			w.WriteHeader(na.Status)
 		}
@@ -170,6 +208,8 @@ type InternalError struct {
 func (InternalError) SetRequest(*http.Request) {
 }
 func (ie InternalError) Execute(w http.ResponseWriter) {
+	setContentType(w, "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusInternalServerError)
 	io.WriteString(w, "<h1>Internal Server Error</h1>")
 }
 
@@ -231,3 +271,330 @@ func (uh UniqueHandler) Execute(w http.ResponseWriter) {
 func (UniqueHandler) String() string {
 	return "One-off Handler"
 }
+
+// setContentType sets the Content-Type header unless it was already set.
+func setContentType(w http.ResponseWriter, contentType string) {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+}
+
+// Text returns a plain text Result.
+func Text(content string) Result {
+	return String{Content: content}
+}
+
+func XML(data interface{}) Result {
+	return XMLData{Data: data}
+}
+
+type XMLData struct {
+	Data   interface{}
+	Status int
+}
+
+func (XMLData) SetRequest(*http.Request) {
+}
+
+func (r XMLData) Execute(w http.ResponseWriter) {
+	setContentType(w, "application/xml; charset=utf-8")
+	if r.Status != 0 {
+		w.WriteHeader(r.Status)
+	}
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(r.Data)
+}
+
+func (r XMLData) String() string {
+	return "XML Data"
+}
+
+// CSV returns a Result that writes rows as CSV.
+func CSV(rows [][]string) Result {
+	return &CSVData{Rows: rows}
+}
+
+// CSVStream writes each row received from rows as CSV, flushing after
+// every row, until rows is closed or the client disconnects.
+func CSVStream(rows <-chan []string) Result {
+	return &CSVData{Stream: rows}
+}
+
+// CSVSeq writes the rows produced by an iterator as CSV, rows may be a
+// range-over-func iterator like iter.Seq[[]string].
+func CSVSeq(rows func(yield func([]string) bool)) Result {
+	return &CSVData{Seq: rows}
+}
+
+type CSVData struct {
+	Rows   [][]string
+	Stream <-chan []string
+	Seq    func(yield func([]string) bool)
+	Status int
+	// Filename sets a Content-Disposition so the CSV is downloaded
+	Filename string
+	request  *http.Request
+}
+
+func (r *CSVData) SetRequest(req *http.Request) {
+	r.request = req
+}
+
+func (r CSVData) Execute(w http.ResponseWriter) {
+	setContentType(w, "text/csv; charset=utf-8")
+	if r.Filename != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": r.Filename}))
+	}
+	if r.Status != 0 {
+		w.WriteHeader(r.Status)
+	}
+
+	cw := csv.NewWriter(w)
+	cw.WriteAll(r.Rows)
+	flush := func() {
+		cw.Flush()
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	var done <-chan struct{}
+	if r.request != nil {
+		done = r.request.Context().Done()
+	}
+	if r.Stream != nil {
+		for {
+			select {
+			case row, ok := <-r.Stream:
+				if !ok {
+					return
+				}
+				cw.Write(row)
+				flush()
+			case <-done:
+				return
+			}
+		}
+	}
+	if r.Seq != nil {
+		r.Seq(func(row []string) bool {
+			select {
+			case <-done:
+				return false
+			default:
+			}
+			cw.Write(row)
+			return cw.Error() == nil
+		})
+		cw.Flush()
+	}
+}
+
+func (r CSVData) String() string {
+	return "CSV Data"
+}
+
+// Bytes returns a Result that writes data with the given Content-Type.
+func Bytes(contentType string, data []byte) Result {
+	return BytesData{ContentType: contentType, Data: data}
+}
+
+type BytesData struct {
+	ContentType string
+	Data        []byte
+	Status      int
+}
+
+func (BytesData) SetRequest(*http.Request) {
+}
+
+func (r BytesData) Execute(w http.ResponseWriter) {
+	if r.ContentType == "" {
+		r.ContentType = http.DetectContentType(r.Data)
+	}
+	setContentType(w, r.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(r.Data)))
+	if r.Status != 0 {
+		w.WriteHeader(r.Status)
+	}
+	w.Write(r.Data)
+}
+
+func (r BytesData) String() string {
+	return fmt.Sprintf("%d Bytes of %s", len(r.Data), r.ContentType)
+}
+
+// File returns a Result that serves the file at path, with support for
+// conditional and range requests.
+func File(path string) Result {
+	return &FileData{Path: path}
+}
+
+type FileData struct {
+	Path string
+	// Filename sets a Content-Disposition so the file is downloaded
+	Filename string
+	// Status replaces the status chosen by http.ServeContent
+	Status  int
+	request *http.Request
+}
+
+func (r *FileData) SetRequest(req *http.Request) {
+	r.request = req
+}
+
+func (r FileData) Execute(w http.ResponseWriter) {
+	f, err := os.Open(r.Path)
+	if err == nil {
+		defer f.Close()
+	}
+	var fi os.FileInfo
+	if err == nil {
+		fi, err = f.Stat()
+	}
+	if err == nil && fi.IsDir() {
+		err = os.ErrNotExist
+	}
+	switch {
+	case os.IsNotExist(err):
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, "500 internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	name := r.Filename
+	if name != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	} else {
+		name = fi.Name()
+	}
+	if ct := mime.TypeByExtension(filepath.Ext(name)); ct != "" {
+		setContentType(w, ct)
+	}
+	if r.Status != 0 || r.request == nil {
+		setContentType(w, "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+		if r.Status != 0 {
+			w.WriteHeader(r.Status)
+		}
+		io.Copy(w, f)
+		return
+	}
+	http.ServeContent(w, r.request, name, fi.ModTime(), f)
+}
+
+func (r FileData) String() string {
+	return fmt.Sprintf("File %s", r.Path)
+}
+
+// Download returns a Result that sends content as an attachment named
+// name, the Content-Type is chosen from the extension of name.
+func Download(name string, content io.Reader) Result {
+	return DownloadData{Filename: name, Content: content}
+}
+
+type DownloadData struct {
+	Filename    string
+	Content     io.Reader
+	ContentType string
+	Status      int
+}
+
+func (DownloadData) SetRequest(*http.Request) {
+}
+
+func (r DownloadData) Execute(w http.ResponseWriter) {
+	ct := r.ContentType
+	if ct == "" {
+		ct = mime.TypeByExtension(filepath.Ext(r.Filename))
+	}
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	setContentType(w, ct)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": r.Filename}))
+	if r.Status != 0 {
+		w.WriteHeader(r.Status)
+	}
+	io.Copy(w, r.Content)
+	if c, ok := r.Content.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+func (r DownloadData) String() string {
+	return fmt.Sprintf("Download %s", r.Filename)
+}
+
+// WithHeader sets a header on the response before res is executed.
+func WithHeader(res Result, key, value string) Result {
+	d := decorate(res)
+	d.header.Set(key, value)
+	return d
+}
+
+// WithStatus changes the status code written by res to status.
+func WithStatus(res Result, status int) Result {
+	d := decorate(res)
+	d.status = status
+	return d
+}
+
+// decorated is a Result with extra headers or a different status, errors
+// carried by the Result are handled without the headers or status.
+type decorated struct {
+	Result
+	header http.Header
+	status int
+}
+
+func decorate(res Result) *decorated {
+	if d, ok := res.(*decorated); ok {
+		return d
+	}
+	return &decorated{Result: res, header: http.Header{}}
+}
+
+func (d *decorated) Execute(w http.ResponseWriter) {
+	for k, v := range d.header {
+		w.Header()[k] = v
+	}
+	if d.status == 0 {
+		d.Result.Execute(w)
+		return
+	}
+	sw := &statusWriter{ResponseWriter: w, status: d.status}
+	d.Result.Execute(sw)
+	sw.WriteHeader(0)
+}
+
+func (d *decorated) String() string {
+	return d.Result.String()
+}
+
+// statusWriter replaces the status code written by a Result.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+}
+
+func (sw *statusWriter) WriteHeader(int) {
+	if !sw.wrote {
+		sw.wrote = true
+		sw.ResponseWriter.WriteHeader(sw.status)
+	}
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	sw.WriteHeader(0)
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *statusWriter) Flush() {
+	sw.WriteHeader(0)
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -1,8 +1,12 @@
 package router
 
 import (
+	"fmt"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
+	"time"
 )
 
 type RetrieveTree struct {
@@ -10,12 +14,31 @@ type RetrieveTree struct {
 }
 
 type Branch struct {
-	Static   map[string]*Branch
-	Name     string
-	Path     string
-	Dynamic  *Branch
-	Fallback http.Handler
-	Leaves   []Leaf
+	Static map[string]*Branch
+	Name   string
+	Path   string
+	Parent *Branch
+	// Dynamic branches are tried in order, see DynamicPriority
+	Dynamic    []*Branch
+	Constraint *regexp.Regexp
+	// Wildcard captures the rest of the path, it is tried last
+	Wildcard   *Branch
+	Fallback   http.Handler
+	Middleware []func(http.Handler) http.Handler
+	CORS       *CORSPolicy
+	Formats    []string
+	Timeout    time.Duration
+	Leaves     []Leaf
+	// Host is set on the root Branch of a Router.Host SubRoute, and
+	// Hosts lists those branches on the root Branch of the Router
+	Host  string
+	Hosts []*Branch
+	// Conflicts records ambiguous routes inserted beneath this Branch
+	Conflicts []error
+
+	priority   int
+	onConflict func(RouteConflict)
+	routes     *routes
 }
 
 func NewTree() *RetrieveTree {
@@ -34,10 +57,36 @@ type Matches struct {
 	Primary   []Leaf
 	Secondary []Leaf
 	Fallback  http.Handler
-	ID        map[string]string
+	// ID holds the URL params for the Primary leaves, SecondaryID holds
+	// the params for the Secondary leaves
+	ID          map[string]string
+	SecondaryID map[string]string
+	// Format is the format suffix removed from the path, like "json"
+	Format string
+
+	fallbackBranch *Branch
 }
 
+// Retrieve finds the leaves for the first route matching path. Static
+// segments are preferred over constrained dynamic segments, which are
+// preferred over unconstrained dynamic segments.
 func (rt RetrieveTree) Retrieve(path string) Matches {
+	return rt.retrieve(path, 1)
+}
+
+// RetrieveWithFallback is like Retrieve, but also finds the next best
+// route matching path, so /users/:users can be tried when the leaves
+// for /users/nerd decline a request.
+func (rt RetrieveTree) RetrieveWithFallback(path string) Matches {
+	return rt.retrieve(path, 2)
+}
+
+type branchMatch struct {
+	branch *Branch
+	id     map[string]string
+}
+
+func (rt RetrieveTree) retrieve(path string, limit int) Matches {
 	r := Matches{
 		ID: map[string]string{},
 	}
@@ -45,98 +94,124 @@ func (rt RetrieveTree) Retrieve(path string) Matches {
 		return r
 	}
 
-	splits := strings.Split(path, "/")
-	current := rt.Branch
-	for _, split := range splits {
-		if split == "" {
-			continue
+	splits := []string{}
+	for _, split := range strings.Split(path, "/") {
+		if split != "" {
+			splits = append(splits, split)
 		}
+	}
+	found := rt.Branch.search(splits, map[string]string{}, nil, limit)
+	if len(found) > 0 {
+		r.Primary = found[0].branch.Leaves
+		r.ID = found[0].id
+	}
+	if len(found) > 1 {
+		r.Secondary = found[1].branch.Leaves
+		r.SecondaryID = found[1].id
+	}
 
+	current := rt.Branch
+	if len(found) > 0 {
+		current = found[0].branch
+	} else {
+		current = rt.Branch.deepest(splits)
+	}
+	for ; current != nil; current = current.Parent {
 		if current.Fallback != nil {
 			r.Fallback = current.Fallback
-		}
-		if current.Static == nil && current.Dynamic == nil {
-			return r
-		}
-
-		if br, ok := current.Static[split]; ok {
-			current = br
-		} else if current.Dynamic != nil {
-			current = current.Dynamic
-			r.ID[current.Name] = split
-		} else {
-			return r
+			r.fallbackBranch = current
+			break
 		}
 	}
-	r.Primary = current.Leaves
 	return r
 }
 
-func (rt RetrieveTree) RetrieveWithFallback(path string) Matches {
-	r := Matches{
-		ID: map[string]string{},
-	}
-	if rt.Branch == nil {
-		return r
+// search walks the tree depth first, returning up to limit branches
+// with leaves that match the path segments in splits.
+func (b *Branch) search(splits []string, id map[string]string, found []branchMatch, limit int) []branchMatch {
+	if len(splits) == 0 {
+		if len(b.Leaves) > 0 {
+			matched := make(map[string]string, len(id))
+			for k, v := range id {
+				matched[k] = v
+			}
+			found = append(found, branchMatch{b, matched})
+		}
+		return found
 	}
 
-	splits := strings.Split(path, "/")
-	current := rt.Branch
-	backtrack := current.Dynamic
-
-	for _, split := range splits {
-		if split == "" {
+	split := splits[0]
+	if br, ok := b.Static[split]; ok {
+		found = br.search(splits[1:], id, found, limit)
+	}
+	for _, br := range b.Dynamic {
+		if len(found) >= limit {
+			break
+		}
+		if br.Constraint != nil && !br.Constraint.MatchString(split) {
 			continue
 		}
-		if current.Static == nil && current.Dynamic == nil && backtrack == nil {
-			return r
+		id[br.Name] = split
+		found = br.search(splits[1:], id, found, limit)
+		delete(id, br.Name)
+	}
+	if b.Wildcard != nil && len(found) < limit && len(b.Wildcard.Leaves) > 0 {
+		if rest, ok := wildcardValue(splits); ok {
+			id[b.Wildcard.Name] = rest
+			found = b.Wildcard.search(nil, id, found, limit)
+			delete(id, b.Wildcard.Name)
 		}
+	}
+	return found
+}
 
-		if current.Fallback != nil {
-			r.Fallback = current.Fallback
+// wildcardValue joins the remaining path segments for a wildcard,
+// rejecting paths that try to move up a directory.
+func wildcardValue(splits []string) (string, bool) {
+	for _, split := range splits {
+		if split == "." || split == ".." {
+			return "", false
 		}
+	}
+	return strings.Join(splits, "/"), true
+}
+
+// deepest returns the deepest Branch that can be reached by following
+// splits, used to find the Fallback for paths without any matches.
+func (b *Branch) deepest(splits []string) *Branch {
+	current := b
+	for _, split := range splits {
 		if br, ok := current.Static[split]; ok {
 			current = br
-			if current.Dynamic != nil {
-				backtrack = current.Dynamic
-				r.ID["backtrack_value"] = split
+			continue
+		}
+		next := (*Branch)(nil)
+		for _, br := range current.Dynamic {
+			if br.Constraint == nil || br.Constraint.MatchString(split) {
+				next = br
+				break
 			}
-		} else if current.Dynamic != nil {
-			current = current.Dynamic
-			r.ID[current.Name] = split
-			backtrack = nil
-			delete(r.ID, "backtrack_value")
-
-		} else if backtrack != nil {
-			r.ID[backtrack.Name] = r.ID["backtrack_value"]
-			delete(r.ID, "backtrack_value")
-
-			if br, ok := backtrack.Static[split]; ok {
-				current = br
-				if backtrack.Dynamic != nil {
-					backtrack = backtrack.Dynamic
-					r.ID["backtrack_value"] = split
-				} else {
-					backtrack = nil
-				}
-			} else if backtrack.Dynamic != nil {
-				current = backtrack.Dynamic
-				backtrack = nil
-				delete(r.ID, "backtrack_value")
-			} else {
-				return r
+		}
+		if next == nil {
+			if current.Wildcard != nil {
+				return current.Wildcard
 			}
-		} else {
-			return r
+			break
 		}
+		current = next
 	}
-	r.Primary = current.Leaves
-	if backtrack != nil {
-		r.Secondary = backtrack.Leaves
-	}
-	return r
+	return current
 }
+
 func (b *Branch) InsertPath(path string) *Branch {
+	var br *Branch
+	b.edit(func() {
+		br = b.insertPath(path)
+	})
+	return br
+}
+
+func (b *Branch) insertPath(path string) *Branch {
 	splits := strings.Split(path, "/")
 	current := b
 	if path == "" {
@@ -146,32 +221,204 @@ func (b *Branch) InsertPath(path string) *Branch {
 		if split == "" {
 			continue
 		}
-		switch {
-		// Dynamic Option
-		case split[0] == ':' && current.Dynamic == nil:
-			current.Dynamic = &Branch{Name: split[1:], Path: current.Path + "/" + split}
-			fallthrough
-		case split[0] == ':':
-			current = current.Dynamic
+		if current.Parent != nil && current.Parent.Wildcard == current {
+			panic(fmt.Sprintf("router: wildcard must be the last segment of '%s'", path))
+		}
+		if name, ok := wildcardParam(split); ok {
+			if current.Wildcard == nil {
+				current.Wildcard = &Branch{Name: name, Path: current.Path + "/" + split, Parent: current}
+			} else if current.Wildcard.Name != name {
+				current.conflict(RouteConflict{
+					Kind: ShadowedRoute,
+					Path: current.Wildcard.Path,
+					Message: fmt.Sprintf(
+						"Wildcard '%s' conflicts with '%s'",
+						split, current.Wildcard.Path,
+					),
+				})
+			}
+			current = current.Wildcard
+			continue
+		}
+		if name, constraint, ok := parseSegment(split); ok {
+			current = current.insertDynamic(split, name, constraint)
+			continue
+		}
 
-		// Static Option
-		case current.Static == nil:
+		if current.Static == nil {
 			current.Static = make(map[string]*Branch)
-			fallthrough
-		case current.Static[split] == nil:
-			current.Static[split] = &Branch{Path: current.Path + "/" + split}
-			fallthrough
-		default:
-			current = current.Static[split]
 		}
+		if current.Static[split] == nil {
+			current.Static[split] = &Branch{Path: current.Path + "/" + split, Parent: current}
+		}
+		current = current.Static[split]
 	}
 	return current
 }
 
+// Priorities for dynamic branches, branches with a higher priority are
+// tried first, and branches with the same priority are tried in the order
+// they were inserted.
+const (
+	DynamicPriority = iota
+	PatternPriority
+	NamedConstraintPriority
+)
+
+// insertDynamic finds or creates the dynamic child for a segment. A
+// dynamic child with the same constraint but a different name can never
+// be reached for a path that the existing child also handles, so it is
+// inserted but recorded as a conflict.
+func (b *Branch) insertDynamic(split, name, constraint string) *Branch {
+	pattern := ""
+	priority := DynamicPriority
+	if constraint != "" {
+		pattern = constraintPattern(constraint)
+		priority = PatternPriority
+		if _, ok := Constraints[constraint]; ok {
+			priority = NamedConstraintPriority
+		}
+	}
+
+	for _, br := range b.Dynamic {
+		if br.Name == name && constraintString(br.Constraint) == pattern {
+			return br
+		}
+	}
+	for _, br := range b.Dynamic {
+		if constraintString(br.Constraint) != pattern {
+			continue
+		}
+		b.conflict(RouteConflict{
+			Kind: ShadowedRoute,
+			Path: b.Path + "/" + split,
+			Message: fmt.Sprintf(
+				"Dynamic segment '%s' is shadowed by '%s'",
+				split, br.Path,
+			),
+		})
+	}
+
+	br := &Branch{
+		Name:     name,
+		Path:     b.Path + "/" + split,
+		Parent:   b,
+		priority: priority,
+	}
+	if pattern != "" {
+		br.Constraint = regexp.MustCompile(pattern)
+	}
+	i := len(b.Dynamic)
+	for i > 0 && b.Dynamic[i-1].priority < priority {
+		i--
+	}
+	b.Dynamic = append(b.Dynamic, nil)
+	copy(b.Dynamic[i+1:], b.Dynamic[i:])
+	b.Dynamic[i] = br
+	return br
+}
+
+func constraintString(re *regexp.Regexp) string {
+	if re == nil {
+		return ""
+	}
+	return re.String()
+}
+
+// conflict records an ambiguous route on the Branch.
+func (b *Branch) conflict(rc RouteConflict) {
+	b.Conflicts = append(b.Conflicts, rc)
+	if hook := b.root().onConflict; hook != nil {
+		hook(rc)
+	}
+}
+
+func (b *Branch) root() *Branch {
+	current := b
+	for current.Parent != nil {
+		current = current.Parent
+	}
+	return current
+}
+
+// Conflicts lists the ambiguous routes recorded while inserting routes.
+func (rt RetrieveTree) Conflicts() []error {
+	errs := []error{}
+	br := []*Branch{rt.Branch}
+	for len(br) > 0 {
+		brz := br[0]
+		br = br[1:]
+		errs = append(errs, brz.Conflicts...)
+		br = append(br, brz.children()...)
+	}
+	return errs
+}
+
+// children lists every child Branch of the Branch.
+func (b *Branch) children() []*Branch {
+	children := make([]*Branch, 0, len(b.Static)+len(b.Dynamic)+len(b.Hosts)+1)
+	for _, branch := range b.Static {
+		children = append(children, branch)
+	}
+	children = append(children, b.Dynamic...)
+	if b.Wildcard != nil {
+		children = append(children, b.Wildcard)
+	}
+	children = append(children, b.Hosts...)
+	return children
+}
+
+// Constraints are the named patterns that can be used in dynamic path
+// segments like :id<int>, any other constraint is used as a regular
+// expression that must match the entire segment.
+var Constraints = map[string]string{
+	"int":   `-?[0-9]+`,
+	"uint":  `[0-9]+`,
+	"uuid":  `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`,
+	"alpha": `[a-zA-Z]+`,
+	"alnum": `[a-zA-Z0-9]+`,
+}
+
+func constraintPattern(constraint string) string {
+	if pattern, ok := Constraints[constraint]; ok {
+		constraint = pattern
+	}
+	return "^(?:" + constraint + ")$"
+}
+
+// parseSegment splits a dynamic path segment like :id<int> into the
+// param name and the constraint.
+func parseSegment(segment string) (name, constraint string, ok bool) {
+	if segment == "" || segment[0] != ':' {
+		return "", "", false
+	}
+	name = segment[1:]
+	if i := strings.IndexByte(name, '<'); i >= 0 && name[len(name)-1] == '>' {
+		name, constraint = name[:i], name[i+1:len(name)-1]
+	}
+	return name, constraint, true
+}
+
 type contexter interface {
 	SetContext(map[string]interface{})
 }
 
+type cacher interface {
+	SetCache(*Cache)
+}
+
+type routerSetter interface {
+	SetRouter(*Router)
+}
+
+type formatSetter interface {
+	SetFormat(string)
+}
+
+type formatSuffixSetter interface {
+	setFormatSuffix(bool)
+}
+
 type prefilter interface {
 	PreFilter() Result
 }
@@ -181,11 +428,21 @@ type preitem interface {
 }
 
 func (b *Branch) Insert(path string, item Leaf) *Branch {
-	br := b.InsertPath(path)
+	var br *Branch
+	b.edit(func() {
+		br = b.insert(path, item)
+	})
+	return br
+}
+
+func (b *Branch) insert(path string, item Leaf) *Branch {
+	br := b.insertPath(path)
 	if item.Ctrl != nil {
 		dc := item.Ctrl.Dupe()
 		_, scok := dc.(contexter)
 		item.SetContext = scok
+		_, cok := dc.(cacher)
+		item.SetCache = cok
 		_, pfok := dc.(prefilter)
 		item.PreFilter = pfok
 		_, piok := dc.(preitem)
@@ -193,7 +450,15 @@ func (b *Branch) Insert(path string, item Leaf) *Branch {
 	}
 
 	item.Path = br.Path
+	item.Host = br.hostPattern()
+	item.branch = br
 	br.Leaves = append(br.Leaves, item)
+	if hook := b.root().onConflict; hook != nil {
+		rt := RetrieveTree{b.root()}
+		for _, rc := range rt.leafConflicts(br, item) {
+			hook(rc)
+		}
+	}
 	return br
 }
 
@@ -204,16 +469,22 @@ func (rt RetrieveTree) ListLeaves() []Leaf {
 		brz := br[0]
 		br = br[1:]
 		lf = append(lf, brz.Leaves...)
-		for _, branch := range brz.Static {
-			br = append(br, branch)
-		}
-		if brz.Dynamic != nil {
-			br = append(br, brz.Dynamic)
-		}
+		br = append(br, brz.children()...)
 	}
 	return lf
 }
 
+// FindLeaf returns the first Leaf with the given route name, searching
+// the tree breadth first so shallower routes are found first.
+func (rt RetrieveTree) FindLeaf(name string) (Leaf, bool) {
+	for _, leaf := range rt.ListLeaves() {
+		if leaf.Name == name {
+			return leaf, true
+		}
+	}
+	return Leaf{}, false
+}
+
 type Leaf struct {
 	Method               string
 	Scheme               string
@@ -221,8 +492,117 @@ type Leaf struct {
 	Item                 bool
 	Action               string
 	Path                 string
+	Host                 string
 	Ctrl                 DupableController
 	Callable             func(Controller) Result
 	SetContext, SetCache bool
 	PreFilter, PreItem   bool
+
+	branch *Branch
+}
+
+// Wrap applies the Middleware of the Branch and its parents to h, with
+// the root Branch's Middleware being the outermost.
+func (b *Branch) Wrap(h http.Handler) http.Handler {
+	for current := b; current != nil; current = current.Parent {
+		for i := len(current.Middleware) - 1; i >= 0; i-- {
+			h = current.Middleware[i](h)
+		}
+	}
+	return h
+}
+
+// wrapOwn applies only the Middleware of the Branch itself to h.
+func (b *Branch) wrapOwn(h http.Handler) http.Handler {
+	for i := len(b.Middleware) - 1; i >= 0; i-- {
+		h = b.Middleware[i](h)
+	}
+	return h
+}
+
+// chain returns the Branch and its parents, starting at the root.
+func (b *Branch) chain() []*Branch {
+	chain := []*Branch{}
+	for current := b; current != nil; current = current.Parent {
+		chain = append([]*Branch{current}, chain...)
+	}
+	return chain
+}
+
+// URL builds the path to the Leaf, filling in the dynamic segments of
+// the Leaf's Path from params. Every dynamic segment must have a value
+// in params, and every value in params must be used. Leaves with a Host
+// have URLs starting with //host.
+func (l Leaf) URL(params map[string]string, query url.Values) (string, error) {
+	used := map[string]bool{}
+	host := ""
+	if l.Host != "" {
+		h, err := hostURL(l.Host, params, used, l.Name)
+		if err != nil {
+			return "", err
+		}
+		host = "//" + h
+	}
+	splits := strings.Split(l.Path, "/")
+	for i, split := range splits {
+		name, ok := segmentParam(split)
+		if !ok {
+			continue
+		}
+		v, ok := params[name]
+		if !ok {
+			return "", fmt.Errorf("Missing param '%s' for route '%s'", name, l.Name)
+		}
+		if _, wild := wildcardParam(split); wild {
+			parts := strings.Split(v, "/")
+			if _, ok := wildcardValue(parts); !ok {
+				return "", fmt.Errorf("Invalid param '%s' for route '%s'", name, l.Name)
+			}
+			for j := range parts {
+				parts[j] = url.PathEscape(parts[j])
+			}
+			splits[i] = strings.Join(parts, "/")
+		} else {
+			splits[i] = url.PathEscape(v)
+		}
+		used[name] = true
+	}
+	suffix := ""
+	if format := params["format"]; format != "" && !used["format"] {
+		suffix = "." + format
+		used["format"] = true
+	}
+	for k := range params {
+		if !used[k] {
+			return "", fmt.Errorf("Extra param '%s' for route '%s'", k, l.Name)
+		}
+	}
+
+	u := strings.Join(splits, "/")
+	if u == "" {
+		u = "/"
+	}
+	u = host + u + suffix
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u, nil
+}
+
+// wildcardParam returns the param name for a wildcard segment like *path.
+func wildcardParam(segment string) (string, bool) {
+	if segment == "" || segment[0] != '*' {
+		return "", false
+	}
+	return segment[1:], true
+}
+
+// segmentParam returns the param name for a dynamic or wildcard path
+// segment.
+func segmentParam(segment string) (string, bool) {
+	if name, ok := wildcardParam(segment); ok {
+		return name, true
+	}
+	name, _, ok := parseSegment(segment)
+	return name, ok
 }
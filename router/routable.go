@@ -1,92 +1,454 @@
 package router
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"reflect"
+	"runtime/debug"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/websocket"
 )
 
 type Router struct {
-	Tree      *RetrieveTree
-	cache     map[string]interface{}
+	Tree   *RetrieveTree
+	routes *routes
+	// services for controllers, see Provide
+	injector injector
+	// OnError is called with every InternalError, RedirectError and panic
+	// from a controller, instead of the default error handling
 	OnError   func(error, http.ResponseWriter, *http.Request, Controller)
 	LogOutput io.Writer
+	// Development enables detailed error pages
+	Development bool
+	// MethodNotAllowed is called when there are routes for the requested
+	// path, but none for the request method. The Allow header will have
+	// been set before it is called.
+	MethodNotAllowed http.Handler
+	// OnOptions is called for OPTIONS requests to paths without an
+	// OPTIONS route, with the methods routed at the path. The Allow header
+	// will have been set before it is called. By default the Router
+	// responds with 204 No Content.
+	OnOptions func(http.ResponseWriter, *http.Request, []string)
+	// Cache is given to every controller with a SetCache method, it may
+	// be replaced with a bounded Cache before serving requests
+	Cache *Cache
+	// HostScheme is used by URLFor for routes added with Host, it
+	// defaults to http
+	HostScheme string
+	// RePanic causes panics from controllers to be re-raised after they
+	// have been logged and handled, for use in tests
+	RePanic bool
 }
 
 func NewRouter() *Router {
 	r := &Router{Tree: NewTree()}
-	r.cache = make(map[string]interface{})
+	r.routes = newRoutes(r.Tree.Branch)
+	r.Cache = NewCache(0)
 	r.LogOutput = os.Stdout
 	return r
 }
 
 func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	logBuffer := &bytes.Buffer{}
+	rl := logPool.Get().(*requestLog)
+	logBuffer, reqLog := &rl.buf, rl.log
 	io.WriteString(logBuffer, "\n\n")
-	reqLog := log.New(logBuffer, "", log.Lmicroseconds)
-	defer io.Copy(r.LogOutput, logBuffer)
+	defer r.finishLog(rl, req)
 	now := time.Now()
+	rc := &requestContext{Context: req.Context()}
+	req = req.WithContext(rc)
+	defer rc.cleanup()
 
-	results := r.Tree.RetrieveWithFallback(req.URL.Path)
+	table := r.routes.table()
+	results := r.match(table, req)
 	reqLog.Printf("%d Possible Handlers, %d Fallback Handlers", len(results.Primary), len(results.Secondary))
-	if len(results.Primary) == 0 && len(results.Secondary) == 0 {
-		if results.Fallback == nil {
-			reqLog.Println("Bad Route", req.URL.Path)
-			// r.BadRoute(w, req)
+	if len(results.Primary) == 0 && len(results.Secondary) == 0 && results.Fallback == nil {
+		reqLog.Println("Bad Route", req.URL.Path)
+	}
+
+	primary := len(results.Primary)
+	candidates := append(results.Primary[:primary:primary], results.Secondary...)
+	allowed, method := []string{}, req.Method
+	for _, handler := range candidates {
+		if schemeMatch(handler, req) {
+			allowed = append(allowed, handler.Method)
+		}
+	}
+	if isPreflight(req) && len(allowed) > 0 && !contains(allowed, "OPTIONS") {
+		matched := preflightBranch(candidates, req)
+		if policy := matched.corsPolicy(); policy != nil {
+			reqLog.Println("Responding to CORS preflight request")
+			matched.Wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				policy.preflight(w, req, allowed)
+			})).ServeHTTP(w, req)
+			reqLog.Printf("Completed request in %v\n", time.Since(now))
 			return
-		} else {
-			results.Fallback.ServeHTTP(w, req)
 		}
 	}
+	if req.Method == "HEAD" && !contains(allowed, "HEAD") {
+		reqLog.Println("Using GET handlers for HEAD request")
+		method = "GET"
+		w = headWriter{w}
+	}
 
-	for _, handler := range append(results.Primary, results.Secondary...) {
-		schemeMatch := false
-		if req.Header.Get("Upgrade") == "websocket" {
-			schemeMatch = handler.Scheme == "ws"
-		} else if handler.Scheme == "http" {
-			schemeMatch = true
+	// every Leaf that may serve the request is a target, followed by the
+	// response for when they all decline
+	targets := []target{}
+	methodMatch := false
+	for i, handler := range candidates {
+		if !schemeMatch(handler, req) {
+			reqLog.Printf("Skipping %s.%s due to incorrect scheme\n", ctrlName(handler.Ctrl), handler.Action)
+			continue
 		}
-		if handler.Method != req.Method || !schemeMatch {
+		if handler.Method != method && handler.Method != "*" {
 			reqLog.Printf("Skipping %s.%s due to incorrect method\n", ctrlName(handler.Ctrl), handler.Action)
 			continue
 		}
-		// prepare
-		ctrl, res := callCtrl(w, req, handler, results.ID, reqLog)
+		methodMatch = true
+		id := results.ID
+		if i >= primary {
+			id = results.SecondaryID
+		}
+		handler := handler
+		targets = append(targets, target{handler.branch, func(w http.ResponseWriter, req *http.Request) bool {
+			return r.serveLeaf(w, req, handler, id, results.Format, reqLog, logBuffer)
+		}})
+	}
+	switch {
+	case len(allowed) > 0 && !methodMatch && req.Method == "OPTIONS":
+		targets = append(targets, target{candidates[0].branch, func(w http.ResponseWriter, req *http.Request) bool {
+			reqLog.Println("Responding to OPTIONS request")
+			addCORS(candidates[0].branch, w, req)
+			w.Header().Set("Allow", allowHeader(allowed))
+			if r.OnOptions != nil {
+				r.OnOptions(w, req, allowed)
+			} else {
+				w.WriteHeader(http.StatusNoContent)
+			}
+			return true
+		}})
+	case len(allowed) > 0 && !methodMatch:
+		targets = append(targets, target{candidates[0].branch, func(w http.ResponseWriter, req *http.Request) bool {
+			allow := allowHeader(allowed)
+			reqLog.Printf("Method %s not allowed, allowed methods are %s\n", req.Method, allow)
+			addCORS(candidates[0].branch, w, req)
+			w.Header().Set("Allow", allow)
+			if r.MethodNotAllowed != nil {
+				r.MethodNotAllowed.ServeHTTP(w, req)
+			} else {
+				methodNotAllowed(w, req)
+			}
+			return true
+		}})
+	case results.Fallback != nil:
+		targets = append(targets, target{results.fallbackBranch, func(w http.ResponseWriter, req *http.Request) bool {
+			addCORS(results.fallbackBranch, w, req)
+			req, cancel := withTimeout(results.fallbackBranch, req)
+			defer cancel()
+			results.Fallback.ServeHTTP(w, req)
+			return true
+		}})
+	default:
+		targets = append(targets, target{table.root, func(w http.ResponseWriter, req *http.Request) bool {
+			addCORS(table.root, w, req)
+			http.NotFound(w, req)
+			return true
+		}})
+	}
+
+	next := 0
+	dispatch(w, req, nil, targets, &next)
+	reqLog.Printf("Completed request in %v\n", time.Since(now))
+}
+
+// target is a handler that may serve a request inside the Middleware of
+// branch, serve returns false if it declined the request.
+type target struct {
+	branch *Branch
+	serve  func(http.ResponseWriter, *http.Request) bool
+}
+
+// dispatch tries targets in order, starting at *next, until one serves
+// the request. The Middleware of a Branch wraps the targets at or beneath
+// it, so the Middleware shared by several targets only runs once and a
+// target never runs inside the Middleware of a Branch it isn't under.
+// Middleware that doesn't call the next handler has served the request.
+// dispatch returns when a target isn't beneath prefix.
+func dispatch(w http.ResponseWriter, req *http.Request, prefix []*Branch, targets []target, next *int) bool {
+	for *next < len(targets) {
+		t := targets[*next]
+		chain := t.branch.chain()
+		if len(chain) < len(prefix) || (len(prefix) > 0 && chain[len(prefix)-1] != prefix[len(prefix)-1]) {
+			return false
+		}
+		if len(chain) == len(prefix) {
+			*next++
+			if t.serve(w, req) {
+				return true
+			}
+			continue
+		}
+
+		branch := chain[len(prefix)]
+		called, served := false, false
+		branch.wrapOwn(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			called = true
+			served = dispatch(w, req, chain[:len(prefix)+1], targets, next)
+		})).ServeHTTP(w, req)
+		if !called || served {
+			return true
+		}
+	}
+	return false
+}
+
+// preflightBranch returns the Branch whose CORS policy answers a
+// preflight request, the first route for the requested method.
+func preflightBranch(candidates []Leaf, req *http.Request) *Branch {
+	requested := req.Header.Get("Access-Control-Request-Method")
+	for _, l := range candidates {
+		if schemeMatch(l, req) && (l.Method == requested || l.Method == "*") {
+			return l.branch
+		}
+	}
+	return candidates[0].branch
+}
+
+// addCORS adds the CORS headers for the policy of b to a response.
+func addCORS(b *Branch, w http.ResponseWriter, req *http.Request) {
+	if policy := b.corsPolicy(); policy != nil {
+		policy.decorate(w, req)
+	}
+}
+
+// match finds the routes for a request, a format suffix is removed from
+// the path when the route for the rest of the path allows the format.
+func (r *Router) match(table *routeTable, req *http.Request) Matches {
+	if ext, stripped, ok := formatSuffix(req.URL.Path); ok {
+		results := table.matcher.matchHost(req.Host, stripped, 2)
+		if len(results.Primary) > 0 && contains(results.Primary[0].branch.formats(), ext) {
+			results.Format = ext
+			return results
+		}
+	}
+	return table.matcher.matchHost(req.Host, req.URL.Path, 2)
+}
+
+func schemeMatch(l Leaf, req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "websocket" {
+		return l.Scheme == "ws"
+	}
+	return l.Scheme == "http"
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func methodNotAllowed(w http.ResponseWriter, req *http.Request) {
+	http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+}
+
+// allowHeader builds the value for an Allow header from a list of
+// methods that may contain duplicates. HEAD and OPTIONS are added since
+// the Router answers them automatically.
+func allowHeader(methods []string) string {
+	seen := map[string]bool{"OPTIONS": true}
+	allow := []string{"OPTIONS"}
+	if contains(methods, "GET") {
+		seen["HEAD"] = true
+		allow = append(allow, "HEAD")
+	}
+	for _, m := range methods {
+		if !seen[m] {
+			seen[m] = true
+			allow = append(allow, m)
+		}
+	}
+	sort.Strings(allow)
+	return strings.Join(allow, ", ")
+}
+
+// headWriter discards the body of GET handlers used for HEAD requests.
+type headWriter struct {
+	http.ResponseWriter
+}
+
+func (hw headWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+// sentWriter records whether a response was started, so a panic after
+// it doesn't write an error response over it.
+type sentWriter struct {
+	http.ResponseWriter
+	sent bool
+}
+
+func (sw *sentWriter) WriteHeader(code int) {
+	if code >= 200 {
+		sw.sent = true
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *sentWriter) Write(b []byte) (int, error) {
+	sw.sent = true
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *sentWriter) Flush() {
+	sw.sent = true
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sw *sentWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	sw.sent = true
+	return h.Hijack()
+}
+
+// Unwrap returns the ResponseWriter for http.ResponseController.
+func (sw *sentWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// requestLog is the per-request log, they are reused between requests
+// unless the request may outlive ServeHTTP.
+type requestLog struct {
+	buf bytes.Buffer
+	log *log.Logger
+}
+
+var logPool = sync.Pool{
+	New: func() interface{} {
+		rl := &requestLog{}
+		rl.log = log.New(&rl.buf, "", log.Lmicroseconds)
+		return rl
+	},
+}
+
+func (r *Router) finishLog(rl *requestLog, req *http.Request) {
+	rl.buf.WriteTo(r.LogOutput)
+	// websocket handlers may still be logging, and large buffers
+	// shouldn't be kept around
+	if req.Header.Get("Upgrade") != "websocket" && rl.buf.Cap() <= 64*1024 {
+		rl.buf.Reset()
+		logPool.Put(rl)
+	}
+}
+
+// serveLeaf runs the controller for a Leaf, it returns false if the
+// controller declined the request so the next Leaf may be tried. Values
+// the controller set with SetValue and the CORS headers of the Leaf are
+// rolled back when it declines.
+func (r *Router) serveLeaf(w http.ResponseWriter, req *http.Request, leaf Leaf, id map[string]string, format string, reqLog *log.Logger, logBuffer *bytes.Buffer) bool {
+	rc, _ := req.Context().Value(requestContextKey{}).(*requestContext)
+	var values map[interface{}]interface{}
+	if rc != nil {
+		values = rc.snapshot()
+	}
+	header := http.Header{}
+	for k, v := range w.Header() {
+		header[k] = v
+	}
+	addCORS(leaf.branch, w, req)
+	skipped := false
+	sw := &sentWriter{ResponseWriter: w}
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var ctrl Controller
+		defer func() {
+			if rec := recover(); rec != nil {
+				pe := PanicError{Value: rec, Stack: debug.Stack()}
+				reqLog.Printf("%s\n%s", pe.Error(), pe.Stack)
+				// an error response can't replace a response that was
+				// already started
+				if sw.sent {
+					reqLog.Println("Response was already sent, not handling the panic")
+				} else {
+					r.handleError(pe, w, req, ctrl, leaf, id, logBuffer)
+				}
+				if r.RePanic {
+					panic(rec)
+				}
+			}
+		}()
+
+		ctrl, res := callCtrl(r, w, req, leaf, id, format, reqLog)
 		if res != nil {
 			if _, ok := res.(NotFound); ok {
 				reqLog.Println("Aborting current handler, starting next handler")
-				continue
+				skipped = true
+				return
 			}
-			res.SetRequest(req)
-			res.Execute(w)
-			reqLog.Println(res)
-			reqLog.Printf("Completed request in %v\n", time.Since(now))
+		} else {
+			res = leaf.Callable(ctrl)
+			if res == nil {
+				skipped = true
+				return
+			}
+		}
+		reqLog.Println(res)
+		if err, ok := resultError(res); ok {
+			r.handleError(err, w, req, ctrl, leaf, id, logBuffer)
 			return
 		}
-		res = handler.Callable(ctrl)
-		if res == nil {
-			continue
+		if req.Context().Err() == context.DeadlineExceeded {
+			reqLog.Println("Route timed out before the Result was executed")
+			http.Error(w, "503 service unavailable", http.StatusServiceUnavailable)
+			return
 		}
 		res.SetRequest(req)
 		res.Execute(w)
-		reqLog.Println(res)
-		reqLog.Printf("Completed request in %v\n", time.Since(now))
-		return
-	}
-	if results.Fallback != nil {
-		results.Fallback.ServeHTTP(w, req)
-	} else {
-		http.NotFound(w, req)
+	})
+
+	req, cancel := withTimeout(leaf.branch, req)
+	defer cancel()
+	h.ServeHTTP(sw, req)
+	if skipped {
+		// the next target sets its own CORS headers
+		for k := range w.Header() {
+			if _, ok := header[k]; !ok {
+				w.Header().Del(k)
+			}
+		}
+		for k, v := range header {
+			w.Header()[k] = v
+		}
+		if rc != nil {
+			rc.restore(values)
+		}
 	}
-	reqLog.Printf("Completed request in %v\n", time.Since(now))
+	return !skipped
+}
+
+// Use adds Middleware to the root of the Router, so it wraps every
+// request the Router handles, including Fallback handlers.
+func (r *Router) Use(mw ...func(http.Handler) http.Handler) {
+	r.Tree.Branch.edit(func() {
+		r.Tree.Branch.Middleware = append(r.Tree.Branch.Middleware, mw...)
+	})
 }
 
 func (r *Router) One(ctrl Controller) *SubRoute {
@@ -109,7 +471,9 @@ func (r *Router) Namespace(name string) *SubRoute {
 // for other SubRoutes. This is the base handler, best used for a top-level
 // 404 Handler.
 func (r *Router) SetHandler(h http.Handler) {
-	r.Tree.Branch.Fallback = h
+	r.Tree.Branch.edit(func() {
+		r.Tree.Branch.Fallback = h
+	})
 }
 
 func (r *Router) PrefixHandler(prefix string, h http.Handler) *SubRoute {
@@ -133,7 +497,7 @@ type RouteDesc struct {
 }
 
 func (r *Router) RouteList() []RouteDesc {
-	rl := r.Tree.ListLeaves()
+	rl := r.published().ListLeaves()
 	rds := make([]RouteDesc, len(rl))
 	for i := range rl {
 		rds[i] = RouteDesc{
@@ -146,6 +510,26 @@ func (r *Router) RouteList() []RouteDesc {
 	return rds
 }
 
+// URLFor builds the path for the route named name, substituting the
+// dynamic segments of the route with the values in params and adding
+// query as the query string. An error is returned if the route does not
+// exist, or if params is missing a segment or has extra values.
+func (r *Router) URLFor(name string, params map[string]string, query url.Values) (string, error) {
+	leaf, ok := r.published().FindLeaf(name)
+	if !ok {
+		return "", fmt.Errorf("No route named '%s'", name)
+	}
+	u, err := leaf.URL(params, query)
+	if err == nil && leaf.Host != "" {
+		scheme := r.HostScheme
+		if scheme == "" {
+			scheme = "http"
+		}
+		u = scheme + ":" + u
+	}
+	return u, err
+}
+
 type SubRoute struct {
 	local *Branch
 	name  string
@@ -173,6 +557,9 @@ type createController interface {
 type indexController interface {
 	Index() Result
 }
+type idConstraintController interface {
+	IDConstraint() string
+}
 type otherBaseController interface {
 	OtherBase(*SubRoute)
 }
@@ -187,11 +574,7 @@ type wsBaseController interface {
 }
 
 func (sr *SubRoute) One(ctrl Controller) *SubRoute {
-	var dc DupableController
-	var ok bool
-	if dc, ok = ctrl.(DupableController); !ok {
-		dc = autoDupeCtrl{ctrl}
-	}
+	dc := sr.dupable(ctrl)
 
 	name := ctrl.Path()
 	urlname := name
@@ -207,17 +590,16 @@ func (sr *SubRoute) One(ctrl Controller) *SubRoute {
 	sr.insertOtherItem(dc, ctrl, name)
 	sr.insertWSItem(dc, ctrl, name, urlname+"_path", false)
 
-	return &SubRoute{local: sr.local.InsertPath(name)}
+	return &SubRoute{local: sr.local.InsertPath(name), name: sr.nestedName(name)}
 }
 
 func (sr *SubRoute) Many(ctrl Controller) *SubRoute {
-	var dc DupableController
-	var ok bool
-	if dc, ok = ctrl.(DupableController); !ok {
-		dc = autoDupeCtrl{ctrl}
-	}
+	dc := sr.dupable(ctrl)
 	name := ctrl.Path()
 	itemName := fmt.Sprintf("%[1]s/:%[1]s", name)
+	if ic, ok := ctrl.(idConstraintController); ok {
+		itemName += "<" + ic.IDConstraint() + ">"
+	}
 	urlname := name
 	if len(sr.name) > 0 {
 		urlname = name + "_" + sr.name
@@ -237,11 +619,50 @@ func (sr *SubRoute) Many(ctrl Controller) *SubRoute {
 	sr.insertWSBase(dc, ctrl, name, "ws_"+urlname+"_path", false)
 	sr.insertWSItem(dc, ctrl, itemName, "ws_item_"+urlname+"_path", true)
 
-	return &SubRoute{local: sr.local.InsertPath(itemName)}
+	return &SubRoute{local: sr.local.InsertPath(itemName), name: sr.nestedName(name)}
+}
+
+// dupable returns ctrl if it has a Dupe method, otherwise it is checked
+// with CheckDupe and duplicated with reflection.
+func (sr *SubRoute) dupable(ctrl Controller) DupableController {
+	if dc, ok := ctrl.(DupableController); ok {
+		return dc
+	}
+	if err := CheckDupe(ctrl); err != nil {
+		sr.local.edit(func() {
+			sr.local.conflict(RouteConflict{
+				Kind:    InvalidDupe,
+				Path:    sr.local.Path + "/" + ctrl.Path(),
+				Message: err.Error(),
+			})
+		})
+	}
+	return autoDupeCtrl{ctrl}
 }
 
+// Namespace creates a SubRoute beneath this one at name, the routes One
+// and Many add to it are named with the namespace, like posts_admin_path,
+// so a controller can be added to several namespaces.
 func (sr *SubRoute) Namespace(name string) *SubRoute {
-	return &SubRoute{local: sr.local.InsertPath(name)}
+	return &SubRoute{local: sr.local.InsertPath(name), name: sr.nestedName(name)}
+}
+
+// nestedName returns the name for a SubRoute at path beneath this one,
+// the static parts of path are put before the name of this SubRoute.
+func (sr *SubRoute) nestedName(path string) string {
+	parts := []string{}
+	for _, part := range strings.Split(path, "/") {
+		if i := strings.Index(part, "<"); i >= 0 {
+			part = part[:i]
+		}
+		if part = strings.Trim(part, ":*"); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	if sr.name != "" {
+		parts = append(parts, sr.name)
+	}
+	return strings.Join(parts, "_")
 }
 
 func (sr *SubRoute) Mount(m Module) {
@@ -481,7 +902,20 @@ func (sr *SubRoute) insertWSItem(dctrl DupableController, ctrl Controller, name,
 }
 
 func (sr *SubRoute) SetHandler(h http.Handler) {
-	sr.local.Fallback = h
+	sr.local.edit(func() {
+		sr.local.Fallback = h
+	})
+}
+
+// Use adds Middleware to every Leaf and Fallback handler at or beneath
+// this SubRoute. Middleware from parent SubRoutes runs before Middleware
+// added here. Middleware runs once per request, around the controllers
+// beneath this SubRoute that are tried and the Fallback handler, but
+// never around a handler from outside the SubRoute.
+func (sr *SubRoute) Use(mw ...func(http.Handler) http.Handler) {
+	sr.local.edit(func() {
+		sr.local.Middleware = append(sr.local.Middleware, mw...)
+	})
 }
 func (sr *SubRoute) Any(path string) Endpoint {
 	return Endpoint{path, "*", sr}
@@ -1,9 +1,17 @@
 package router
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/net/websocket"
 )
@@ -236,3 +244,628 @@ func TestDupingNested(t *testing.T) {
 	}
 
 }
+
+func TestURLFor(t *testing.T) {
+	r := NewRouter()
+	r.One(t1Ctrl{})
+	t2 := r.Many(t2Ctrl{})
+	t2.Many(t1Ctrl{})
+
+	u, err := r.URLFor("bar_path", nil, nil)
+	if err != nil || u != "/bar" {
+		t.Fatal("Incorrect index url:", u, err)
+	}
+	u, err = r.URLFor("edit_bar_path", map[string]string{"bar": "123"}, nil)
+	if err != nil || u != "/bar/123/edit" {
+		t.Fatal("Incorrect edit url:", u, err)
+	}
+	u, err = r.URLFor(
+		"show_foo_bar_path",
+		map[string]string{"bar": "12", "foo": "a b"},
+		url.Values{"q": []string{"x"}},
+	)
+	if err != nil || u != "/bar/12/foo/a%20b?q=x" {
+		t.Fatal("Incorrect nested url:", u, err)
+	}
+
+	if _, err = r.URLFor("show_foo_bar_path", map[string]string{"bar": "12"}, nil); err == nil {
+		t.Fatal("Missing param should error")
+	}
+	if _, err = r.URLFor("bar_path", map[string]string{"bar": "12"}, nil); err == nil {
+		t.Fatal("Extra param should error")
+	}
+	if _, err = r.URLFor("missing_path", nil, nil); err == nil {
+		t.Fatal("Missing route should error")
+	}
+}
+
+func TestRouteListJS(t *testing.T) {
+	r := NewRouter()
+	r.One(t1Ctrl{})
+	t2 := r.Many(t2Ctrl{})
+	t2.Many(t1Ctrl{})
+
+	buf := &bytes.Buffer{}
+	if err := r.RouteListJS(buf, JSOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	js := buf.String()
+	expected := `export const showFooBarPath = function(bar, foo, query) { return "/bar/" + encodeURIComponent(bar) + "/foo/" + encodeURIComponent(foo) + _query(query); };`
+	if !strings.Contains(js, expected) {
+		t.Fatal("Missing nested route function:", js)
+	}
+	if !strings.Contains(js, `export const newBarPath = function(query) { return "/bar/new" + _query(query); };`) {
+		t.Fatal("Missing static route function:", js)
+	}
+
+	buf.Reset()
+	r.RouteListJS(buf, JSOptions{Format: CommonJS, Prefix: "/app/"})
+	if !strings.Contains(buf.String(), `module.exports.fooPath = function(query) { return "/app/foo" + _query(query); };`) {
+		t.Fatal("Missing CommonJS route function:", buf.String())
+	}
+
+	r = NewRouter()
+	r.Host(":tenant.example.com:8080").Many(t2Ctrl{})
+	buf.Reset()
+	r.RouteListJS(buf, JSOptions{})
+	expected = `export const showBarPath = function(tenant, bar, query) { return "//" + encodeURIComponent(tenant) + ".example.com:8080/bar/" + encodeURIComponent(bar) + _query(query); };`
+	if !strings.Contains(buf.String(), expected) {
+		t.Fatal("Missing host route function:", buf.String())
+	}
+
+	route := newJSRoute(Leaf{Name: "delete", Path: "/:new/:post_id/:postId/:query/:new"}, "")
+	expected = `function(new_, postId, postId2, query2, query) { return "/" + encodeURIComponent(new_) + "/" + encodeURIComponent(postId) + "/" + encodeURIComponent(postId2) + "/" + encodeURIComponent(query2) + "/" + encodeURIComponent(new_) + _query(query); }`
+	if route.Func != "delete_" || route.function() != expected {
+		t.Fatal("Unexpected identifiers in route function:", route.Func, route.function())
+	}
+}
+
+func TestConstrainedRetrieve(t *testing.T) {
+	rt := NewTree()
+	rt.Insert("/posts/:id<int>", Leaf{Name: "post_path"})
+	rt.Insert("/posts/:slug<[a-z-]+>", Leaf{Name: "post_slug_path"})
+	rt.Insert("/posts/:uuid<uuid>/edit", Leaf{Name: "edit_post_uuid_path"})
+	rt.Insert("/posts/:other", Leaf{Name: "post_other_path"})
+
+	results := rt.Retrieve("/posts/123")
+	if len(results.Primary) != 1 || results.Primary[0].Name != "post_path" || results.ID["id"] != "123" {
+		t.Fatal("Could not retrieve int constrained path", results)
+	}
+	results = rt.RetrieveWithFallback("/posts/hello-world")
+	if len(results.Primary) != 1 || results.Primary[0].Name != "post_slug_path" || results.ID["slug"] != "hello-world" {
+		t.Fatal("Could not retrieve regex constrained path", results)
+	}
+	if len(results.Secondary) != 1 || results.SecondaryID["other"] != "hello-world" {
+		t.Fatal("Could not retrieve unconstrained fallback path", results)
+	}
+	results = rt.Retrieve("/posts/0b5e1a72-3c41-4bd0-9d6e-0f3f0a7c2b11/edit")
+	if len(results.Primary) != 1 || results.Primary[0].Name != "edit_post_uuid_path" {
+		t.Fatal("Could not retrieve uuid constrained path", results)
+	}
+	results = rt.Retrieve("/posts/Hello_World")
+	if len(results.Primary) != 1 || results.Primary[0].Name != "post_other_path" {
+		t.Fatal("Constrained paths should fall through to unconstrained path", results)
+	}
+	results = rt.Retrieve("/posts/nope/edit")
+	if len(results.Primary) != 0 {
+		t.Fatal("Retrieved edit path that doesn't match uuid", results)
+	}
+}
+
+type t4Ctrl struct {
+	*BaseController
+}
+
+func (t4Ctrl) Path() string {
+	return "baz"
+}
+
+func (t4Ctrl) IDConstraint() string {
+	return "int"
+}
+
+func (t4Ctrl) Show() Result {
+	return nil
+}
+
+func TestIDConstraint(t *testing.T) {
+	r := NewRouter()
+	r.Many(t4Ctrl{})
+	if results := r.Tree.Retrieve("/baz/12"); len(results.Primary) != 1 {
+		t.Fatal("Could not retrieve constrained show path")
+	}
+	if results := r.Tree.Retrieve("/baz/abc"); len(results.Primary) != 0 {
+		t.Fatal("Retrieved show path that doesn't match constraint")
+	}
+	u, err := r.URLFor("show_baz_path", map[string]string{"baz": "12"}, nil)
+	if err != nil || u != "/baz/12" {
+		t.Fatal("Incorrect constrained url:", u, err)
+	}
+}
+
+func TestWildcardRetrieve(t *testing.T) {
+	rt := NewTree()
+	rt.Insert("/files/:name", Leaf{Name: "file_path"})
+	rt.Insert("/files/*path", Leaf{Name: "nested_file_path"})
+
+	results := rt.Retrieve("/files/x.css")
+	if len(results.Primary) != 1 || results.Primary[0].Name != "file_path" {
+		t.Fatal("Single segment should prefer dynamic path", results)
+	}
+	results = rt.RetrieveWithFallback("/files/css/vendor/x.css")
+	if len(results.Primary) != 1 || results.ID["path"] != "css/vendor/x.css" {
+		t.Fatal("Could not retrieve wildcard path", results)
+	}
+	results = rt.RetrieveWithFallback("/files/css/../../secret")
+	if len(results.Primary) != 0 || len(results.Secondary) != 0 {
+		t.Fatal("Wildcard matched a path with ..", results)
+	}
+	if len(rt.ListLeaves()) != 2 {
+		t.Fatal("ListLeaves is missing the wildcard leaf")
+	}
+
+	leaf, _ := rt.FindLeaf("nested_file_path")
+	u, err := leaf.URL(map[string]string{"path": "css/my file.css"}, nil)
+	if err != nil || u != "/files/css/my%20file.css" {
+		t.Fatal("Incorrect wildcard url:", u, err)
+	}
+	if _, err = leaf.URL(map[string]string{"path": "../secret"}, nil); err == nil {
+		t.Fatal("Wildcard url should reject ..")
+	}
+}
+
+func TestMultipleDynamic(t *testing.T) {
+	rt := NewTree()
+	rt.Insert("/users/:users/edit", Leaf{Name: "edit_users_path"})
+	rt.Insert("/users/:username/profile", Leaf{Name: "profile_path"})
+	rt.Insert("/users/:id<int>/posts", Leaf{Name: "user_posts_path"})
+	rt.Insert("/users/:slug<[a-z]+>/posts", Leaf{Name: "user_slug_posts_path"})
+
+	results := rt.Retrieve("/users/bob/profile")
+	if len(results.Primary) != 1 || results.ID["username"] != "bob" || results.ID["users"] != "" {
+		t.Fatal("Could not retrieve second dynamic path", results)
+	}
+	results = rt.Retrieve("/users/bob/edit")
+	if len(results.Primary) != 1 || results.ID["users"] != "bob" {
+		t.Fatal("Could not retrieve first dynamic path", results)
+	}
+	results = rt.Retrieve("/users/12/posts")
+	if len(results.Primary) != 1 || results.ID["id"] != "12" {
+		t.Fatal("Named constraint should be tried first", results)
+	}
+	if branches := rt.Branch.Static["users"].Dynamic; len(branches) != 4 ||
+		branches[0].Name != "id" || branches[1].Name != "slug" ||
+		branches[2].Name != "users" || branches[3].Name != "username" {
+		t.Fatal("Dynamic branches in incorrect priority order")
+	}
+
+	conflicts := rt.Conflicts()
+	if len(conflicts) != 1 || !strings.Contains(conflicts[0].Error(), ":username") {
+		t.Fatal("Expected one conflict for :username, got", conflicts)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	r := NewRouter()
+	r.Many(t2Ctrl{})
+	if conflicts := r.Validate(); len(conflicts) != 0 {
+		t.Fatal("Unexpected conflicts:", conflicts)
+	}
+
+	r.Many(t2Ctrl{})
+	r.Namespace("bar").Get("missing").Action("Missing")
+	r.Namespace("users").Get(":users").HandlerFunc(nil)
+	r.Namespace("users").Get(":username").HandlerFunc(nil)
+	kinds := map[ConflictKind]int{}
+	for _, rc := range r.Validate() {
+		kinds[rc.Kind]++
+	}
+	if kinds[DuplicateRoute] != 6 || kinds[MissingAction] != 1 || kinds[ShadowedRoute] != 1 {
+		t.Fatal("Incorrect conflicts:", r.Validate())
+	}
+
+	r = NewRouter()
+	r.One(t1Ctrl{})
+	r.Many(t2Ctrl{&BaseController{}}).Many(t1Ctrl{})
+	r.Namespace("admin").Many(t2Ctrl{&BaseController{}})
+	r.Namespace("api").Many(t2Ctrl{&BaseController{}})
+	if conflicts := r.Validate(); len(conflicts) != 0 {
+		t.Fatal("Nested and namespaced controllers should have unique names:", conflicts)
+	}
+	if u, err := r.URLFor("bar_admin_path", nil, nil); err != nil || u != "/admin/bar" {
+		t.Fatal("Incorrect namespaced url:", u, err)
+	}
+	if u, err := r.URLFor("bar_api_path", nil, nil); err != nil || u != "/api/bar" {
+		t.Fatal("Incorrect namespaced url:", u, err)
+	}
+	r.One(t1Ctrl{Custom: "bar"})
+	kinds = map[ConflictKind]int{}
+	for _, rc := range r.Validate() {
+		kinds[rc.Kind]++
+	}
+	if kinds[DuplicateName] == 0 {
+		t.Fatal("Expected a duplicate name, got", r.Validate())
+	}
+
+	r = NewRouter()
+	r.Strict()
+	r.Namespace("a").One(t1Ctrl{Custom: "b"})
+	func() {
+		defer func() {
+			rc, ok := recover().(RouteConflict)
+			if !ok || rc.Kind != DuplicateName {
+				t.Fatal("Expected strict mode to panic with a duplicate name, got", rc)
+			}
+		}()
+		// b_a_path is shallower than the existing route with the name
+		r.One(t3Ctrl{t1Ctrl{Custom: "b_a"}})
+	}()
+
+	r = NewRouter()
+	r.Strict()
+	r.One(t1Ctrl{})
+	r.Many(t2Ctrl{&BaseController{}}).Many(t1Ctrl{})
+	defer func() {
+		rc, ok := recover().(RouteConflict)
+		if !ok || rc.Kind != DuplicateRoute {
+			t.Fatal("Expected strict mode to panic with a duplicate route, got", rc)
+		}
+	}()
+	r.One(t1Ctrl{})
+	t.Fatal("Strict mode did not panic")
+}
+
+func benchTree() *RetrieveTree {
+	rt := NewTree()
+	rt.Insert("/api/v1/users", Leaf{Name: "users_path"})
+	rt.Insert("/api/v1/users/:users", Leaf{Name: "show_users_path"})
+	rt.Insert("/api/v1/users/:users/edit", Leaf{Name: "edit_users_path"})
+	rt.Insert("/api/v1/users/nerd", Leaf{Name: "nerd_users_path"})
+	rt.Insert("/api/v1/posts/:id<int>", Leaf{Name: "show_posts_path"})
+	rt.Insert("/api/v1/posts/:slug<[a-z-]+>", Leaf{Name: "slug_posts_path"})
+	rt.Insert("/files/*path", Leaf{Name: "files_path"})
+	return rt
+}
+
+func TestFreeze(t *testing.T) {
+	rt := benchTree()
+	m := compile(rt.Branch)
+	for _, path := range []string{
+		"/api/v1/users",
+		"/api/v1/users/",
+		"/api/v1/users/12",
+		"/api/v1/users/nerd",
+		"/api/v1/users/nerd/edit",
+		"/api/v1/posts/12",
+		"/api/v1/posts/hello-world",
+		"/api/v1/posts/Hello",
+		"/api/v2/users",
+		"/files/css//vendor/x.css",
+		"/files/../secret",
+		"/",
+	} {
+		expected := rt.RetrieveWithFallback(path)
+		got := m.match(path, 2)
+		if fmt.Sprint(expected.Primary, expected.Secondary, expected.ID, expected.SecondaryID) !=
+			fmt.Sprint(got.Primary, got.Secondary, got.ID, got.SecondaryID) {
+			t.Fatal("Frozen match differs for", path, expected, got)
+		}
+	}
+}
+
+func benchmarkRetrieve(b *testing.B, path string, frozen bool) {
+	rt := benchTree()
+	m := compile(rt.Branch)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if frozen {
+			m.match(path, 2)
+		} else {
+			rt.RetrieveWithFallback(path)
+		}
+	}
+}
+
+func BenchmarkTreeStatic(b *testing.B)      { benchmarkRetrieve(b, "/api/v1/users", false) }
+func BenchmarkFrozenStatic(b *testing.B)    { benchmarkRetrieve(b, "/api/v1/users", true) }
+func BenchmarkTreeDynamic(b *testing.B)     { benchmarkRetrieve(b, "/api/v1/posts/12", false) }
+func BenchmarkFrozenDynamic(b *testing.B)   { benchmarkRetrieve(b, "/api/v1/posts/12", true) }
+func BenchmarkTreeBacktrack(b *testing.B)   { benchmarkRetrieve(b, "/api/v1/users/nerd/edit", false) }
+func BenchmarkFrozenBacktrack(b *testing.B) { benchmarkRetrieve(b, "/api/v1/users/nerd/edit", true) }
+
+func BenchmarkServeHTTP(b *testing.B) {
+	r := NewRouter()
+	r.LogOutput = ioutil.Discard
+	r.Many(t2Ctrl{})
+	r.Freeze()
+	req, _ := http.NewRequest("GET", "/bar/12", nil)
+	w := httptest.NewRecorder()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.ServeHTTP(w, req)
+	}
+}
+
+func TestCache(t *testing.T) {
+	now := time.Now()
+	c := NewCache(2)
+	c.now = func() time.Time { return now }
+
+	c.Set("name", "platform")
+	c.SetTTL("count", 3, time.Minute)
+	if s, ok := c.String("name"); !ok || s != "platform" {
+		t.Error("Unexpected string:", s, ok)
+	}
+	if _, ok := c.Int("name"); ok {
+		t.Error("String value was returned as an int")
+	}
+	if i, ok := c.Int("count"); !ok || i != 3 {
+		t.Error("Unexpected int:", i, ok)
+	}
+
+	// count was used most recently, so name is evicted
+	c.Set("flag", true)
+	if _, ok := c.Get("name"); ok || c.Len() != 2 {
+		t.Error("Least recently used item was not evicted")
+	}
+	if b, ok := c.Bool("flag"); !ok || !b {
+		t.Error("Unexpected bool:", b, ok)
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.Get("count"); ok || c.Len() != 1 {
+		t.Error("Expired item was returned")
+	}
+
+	calls := 0
+	load := func() (interface{}, error) {
+		calls++
+		return "loaded", nil
+	}
+	for i := 0; i < 2; i++ {
+		if v, err := c.Fetch("lazy", 0, load); err != nil || v != "loaded" {
+			t.Error("Unexpected Fetch result:", v, err)
+		}
+	}
+	if calls != 1 {
+		t.Error("Fetch called load", calls, "times")
+	}
+	c.Delete("lazy")
+	c.Clear()
+	if c.Len() != 0 {
+		t.Error("Cache was not cleared")
+	}
+}
+
+type dupeBenchCtrl struct {
+	*BaseController
+	Current *Leaf
+	Shared  *Router `dupe:"no"`
+	Title   string
+}
+
+func (dupeBenchCtrl) Path() string {
+	return "bench"
+}
+
+//go:generate go run ../cmd/platform-dupe -tests -o dupe_gen_test.go
+
+// genDupeCtrl has the same fields as dupeBenchCtrl, with a Dupe method
+// generated by platform-dupe in dupe_gen_test.go.
+//
+//platform:dupe
+type genDupeCtrl struct {
+	*BaseController
+	Current *Leaf
+	Shared  *Router `dupe:"no"`
+	Title   string
+}
+
+func (genDupeCtrl) Path() string {
+	return "bench"
+}
+
+func TestGeneratedDupe(t *testing.T) {
+	proto := dupeBenchCtrl{&BaseController{}, &Leaf{Name: "a"}, NewRouter(), "title"}
+	reflected := autoDupeCtrl{proto}.Dupe().(*dupeBenchCtrl)
+	generated := genDupeCtrl(proto).Dupe().(*genDupeCtrl)
+	for _, d := range []*dupeBenchCtrl{reflected, (*dupeBenchCtrl)(generated)} {
+		if d.BaseController == proto.BaseController || d.Current == proto.Current ||
+			d.Shared != proto.Shared || d.Current.Name != "a" || d.Title != "title" {
+			t.Errorf("Bad duplicate: %+v", d)
+		}
+	}
+	if d := (genDupeCtrl{}).Dupe().(*genDupeCtrl); d.BaseController == nil || d.Current != nil {
+		t.Errorf("Generated Dupe should allocate embedded pointers only: %+v", d)
+	}
+}
+
+var dupeSink Controller
+
+func BenchmarkDupeReflect(b *testing.B) {
+	dc := autoDupeCtrl{dupeBenchCtrl{&BaseController{}, &Leaf{}, nil, "title"}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dupeSink = dc.Dupe()
+	}
+}
+
+func BenchmarkDupeGenerated(b *testing.B) {
+	dc := genDupeCtrl{&BaseController{}, &Leaf{}, nil, "title"}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dupeSink = dc.Dupe()
+	}
+}
+
+type dupeTags struct {
+	*BaseController
+	Tags    map[string]bool `dupe:"deep"`
+	Items   []*Leaf         `dupe:"deep"`
+	Shared  map[string]bool `dupe:"no"`
+	Scratch []string        `dupe:"zero"`
+	Plain   map[string]string
+	hidden  *Leaf `dupe:"no"`
+	Nested  *Leaf
+}
+
+func (dupeTags) Path() string {
+	return "tags"
+}
+
+type badDupe struct {
+	*BaseController
+	counts map[string]int
+	secret []string `dupe:"deep"`
+	Count  int      `dupe:"deep"`
+	Other  string   `dupe:"copy"`
+	own    *Leaf    `dupe:"no"`
+}
+
+func (badDupe) Path() string {
+	return "bad"
+}
+
+type funcCtrl func()
+
+func (funcCtrl) Path() string                                      { return "func" }
+func (funcCtrl) SetRequestData(http.ResponseWriter, *http.Request) {}
+func (funcCtrl) SetID(map[string]string)                           {}
+func (funcCtrl) SetLogger(*log.Logger)                             {}
+
+func TestDupeSemantics(t *testing.T) {
+	proto := &dupeTags{
+		BaseController: &BaseController{},
+		Tags:           map[string]bool{"a": true},
+		Items:          []*Leaf{{Name: "item"}},
+		Shared:         map[string]bool{},
+		Scratch:        []string{"left over"},
+		Plain:          map[string]string{},
+		hidden:         &Leaf{},
+	}
+	d := autoDupeCtrl{proto}.Dupe().(*dupeTags)
+	if d == proto || d.BaseController == proto.BaseController {
+		t.Fatal("Pointer controller was not copied")
+	}
+	d.Tags["b"] = true
+	d.Items[0].Name = "changed"
+	if len(proto.Tags) != 1 || proto.Items[0].Name != "item" {
+		t.Error("dupe:\"deep\" fields were shared")
+	}
+	d.Shared["x"], d.Plain["x"] = true, "x"
+	if !proto.Shared["x"] || proto.Plain["x"] != "x" || d.hidden != proto.hidden {
+		t.Error("Fields without a tag, or tagged dupe:\"no\", were not shared")
+	}
+	if d.Scratch != nil {
+		t.Error("dupe:\"zero\" field was not reset")
+	}
+	if d.Nested != nil {
+		t.Error("Nil struct pointer was not kept nil")
+	}
+	if name := (autoDupeCtrl{proto}).Name(); name != "dupeTags" {
+		t.Error("Unexpected name for pointer controller:", name)
+	}
+
+	if err := CheckDupe(proto); err != nil {
+		t.Error("Unexpected error:", err)
+	}
+	if err := CheckDupe(genDupeCtrl{}); err != nil {
+		t.Error("Controllers with a Dupe method should not be checked:", err)
+	}
+	if err := CheckDupe(funcCtrl(nil)); err == nil {
+		t.Error("Expected an error for a func controller")
+	}
+	if d := (autoDupeCtrl{t2Ctrl{}}).Dupe().(*t2Ctrl); d.BaseController == nil {
+		t.Error("Nil embedded pointer was not replaced")
+	}
+	err := CheckDupe(badDupe{BaseController: &BaseController{}})
+	de, ok := err.(*DupeError)
+	if !ok || len(de.Problems) != 4 {
+		t.Fatalf("Expected 4 problems, got %v", err)
+	}
+	for i, s := range []string{"badDupe.counts", "badDupe.secret", "badDupe.Count", "badDupe.Other"} {
+		if !strings.Contains(de.Problems[i], s) {
+			t.Errorf("Problem %d should be about %s: %s", i, s, de.Problems[i])
+		}
+	}
+
+	r := NewRouter()
+	r.Many(badDupe{BaseController: &BaseController{}})
+	conflicts := r.Validate()
+	if len(conflicts) != 1 || conflicts[0].Kind != InvalidDupe || conflicts[0].Path != "/bad" {
+		t.Error("Expected an InvalidDupe conflict:", conflicts)
+	}
+}
+
+type dupeNode struct {
+	Name string
+	Next *dupeNode
+	Prev *dupeNode
+}
+
+type cyclicCtrl struct {
+	*BaseController
+	Head  *dupeNode
+	Empty *dupeNode
+	Ring  *dupeNode `dupe:"deep"`
+}
+
+func (cyclicCtrl) Path() string {
+	return "cyclic"
+}
+
+type dupeA struct {
+	B *dupeB
+}
+
+type dupeB struct {
+	A *dupeA
+}
+
+type dupeACtrl struct {
+	*BaseController
+	A *dupeA
+}
+
+type dupeBCtrl struct {
+	*BaseController
+	B *dupeB
+}
+
+func (dupeACtrl) Path() string {
+	return "a"
+}
+
+func (dupeBCtrl) Path() string {
+	return "b"
+}
+
+func TestDupeCyclic(t *testing.T) {
+	a, b := &dupeNode{Name: "a"}, &dupeNode{Name: "b"}
+	a.Next, b.Prev = b, a
+	ring := &dupeNode{Name: "ring"}
+	ring.Next = ring
+	proto := cyclicCtrl{&BaseController{}, a, nil, ring}
+
+	d := autoDupeCtrl{proto}.Dupe().(*cyclicCtrl)
+	if d.Empty != nil {
+		t.Error("Nil pointer was replaced")
+	}
+	if d.Head == a || d.Head.Next == b || d.Head.Next.Name != "b" || d.Head.Next.Prev != d.Head {
+		t.Error("Linked nodes were not copied with their links:", d.Head)
+	}
+	if d.Ring == ring || d.Ring.Next != d.Ring {
+		t.Error("Cyclic dupe:\"deep\" field was not copied:", d.Ring)
+	}
+
+	// the plan for dupeB is built while building the one for dupeA
+	autoDupeCtrl{dupeACtrl{}}.Dupe()
+	pb := &dupeB{A: &dupeA{}}
+	pb.A.B = pb
+	db := autoDupeCtrl{dupeBCtrl{B: pb}}.Dupe().(*dupeBCtrl)
+	if db.B == pb || db.B.A.B != db.B {
+		t.Error("Cycle was not preserved for a type that was cached first:", db.B)
+	}
+}
@@ -1,12 +1,18 @@
 package router
 
 import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/net/websocket"
 )
@@ -135,3 +141,1005 @@ func TestRestControllers(t *testing.T) {
 	}
 	wc.Close()
 }
+
+func TestMiddleware(t *testing.T) {
+	order := []string{}
+	mw := func(name string) func(http.Handler) http.Handler {
+		return func(h http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				h.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	r := NewRouter()
+	r.LogOutput = ioutil.Discard
+	r.Use(mw("root1"), mw("root2"))
+	api := r.Namespace("api")
+	api.Use(mw("api"))
+	api.Many(restCtrl{"posts", &BaseController{}})
+	api.Get("ping").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "pong")
+	})
+	api.Many(ctxCtrl{&BaseController{}}).Use(mw("item"))
+	api.Namespace("ctx").One(declineCtrl{&BaseController{}}).Use(mw("special"))
+	api.SetHandler(http.NotFoundHandler())
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	for path, expected := range map[string]string{
+		"/api/posts/1":    "root1,root2,api",
+		"/api/ping":       "root1,root2,api",
+		"/api/missing":    "root1,root2,api",
+		"/api/ctx?skip=1": "root1,root2,api",
+		"/api/ctx/1":      "root1,root2,api,item",
+		// the special Show declines, ctxCtrl's Show serves beneath item
+		"/api/ctx/special": "root1,root2,api,special,item",
+		"/missing":         "root1,root2",
+	} {
+		order = order[:0]
+		resp, err := http.Get(s.URL + path)
+		if err != nil {
+			t.Fatal("GET", path, err)
+		}
+		resp.Body.Close()
+		if strings.Join(order, ",") != expected {
+			t.Fatal("Incorrect middleware order for", path, order)
+		}
+	}
+}
+
+type declineCtrl struct {
+	*BaseController
+}
+
+func (declineCtrl) Path() string {
+	return "special"
+}
+
+func (declineCtrl) Show() Result {
+	return nil
+}
+
+type errCtrl struct {
+	*BaseController
+}
+
+func (errCtrl) Path() string {
+	return "errors"
+}
+
+func (e errCtrl) PreFilter() Result {
+	if e.Request.URL.Query().Get("redirect") != "" {
+		return RedirectError{Reason: "testing", Location: "/login"}
+	}
+	return nil
+}
+
+func (errCtrl) Index() Result {
+	panic("index exploded")
+}
+
+func (e errCtrl) Show() Result {
+	return InternalError{fmt.Errorf("could not show %s", e.ID["errors"])}
+}
+
+func TestErrorHandling(t *testing.T) {
+	r := NewRouter()
+	r.LogOutput = ioutil.Discard
+	r.Many(errCtrl{&BaseController{}})
+	s := httptest.NewServer(r)
+	defer s.Close()
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get(s.URL + "/errors/12")
+	if err != nil {
+		t.Fatal("GET Show:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 500 {
+		t.Fatal("Expected 500 for InternalError, got", resp.StatusCode)
+	}
+
+	resp, err = client.Get(s.URL + "/errors?redirect=1")
+	if err != nil {
+		t.Fatal("GET Index:", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 302 || resp.Header.Get("Location") != "/login" {
+		t.Fatal("Expected redirect for RedirectError, got", resp.StatusCode)
+	}
+
+	r.Development = true
+	resp, err = client.Get(s.URL + "/errors/12")
+	if err != nil {
+		t.Fatal("GET Show:", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 500 || !strings.Contains(string(body), "could not show 12") || !strings.Contains(string(body), "/errors/:errors") {
+		t.Fatal("Development error page missing details:", string(body))
+	}
+
+	errs := []string{}
+	r.OnError = func(err error, w http.ResponseWriter, req *http.Request, ctrl Controller) {
+		if _, ok := ctrl.(*errCtrl); !ok {
+			t.Errorf("OnError got %T instead of errCtrl", ctrl)
+		}
+		errs = append(errs, err.Error())
+		w.WriteHeader(418)
+	}
+	for _, path := range []string{"/errors", "/errors/12", "/errors?redirect=1"} {
+		resp, err = client.Get(s.URL + path)
+		if err != nil {
+			t.Fatal("GET", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 418 {
+			t.Fatal("OnError not used for", path)
+		}
+	}
+	if len(errs) != 3 || !strings.Contains(errs[0], "index exploded") {
+		t.Fatal("Incorrect errors passed to OnError:", errs)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	r := NewRouter()
+	logs := &bytes.Buffer{}
+	r.LogOutput = logs
+	r.Many(errCtrl{&BaseController{}})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/errors", nil))
+	if w.Code != 500 {
+		t.Fatal("Expected 500 after panic, got", w.Code)
+	}
+	if !strings.Contains(logs.String(), "panic: index exploded") || !strings.Contains(logs.String(), "errCtrl.Index") {
+		t.Fatal("Stack trace missing from request log:", logs.String())
+	}
+
+	// the response was started, so it isn't replaced with a 500
+	r.Namespace("partial").Get("write").HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, "partial")
+		panic("partial exploded")
+	})
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/partial/write", nil))
+	if w.Code != http.StatusAccepted || w.Body.String() != "partial" || !strings.Contains(logs.String(), "panic: partial exploded") {
+		t.Fatal("Panic after the response was sent changed it:", w.Code, w.Body.String())
+	}
+
+	r.RePanic = true
+	defer func() {
+		if rec := recover(); rec != "index exploded" {
+			t.Fatal("Expected panic to be re-raised, got", rec)
+		}
+	}()
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/errors", nil))
+	t.Fatal("Panic was not re-raised")
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	r := NewRouter()
+	r.LogOutput = ioutil.Discard
+	r.Many(restCtrl{"posts", &BaseController{}})
+	r.Namespace("").Post("posts").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "created")
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("DELETE", "/posts", nil))
+	if w.Code != 405 || w.Header().Get("Allow") != "GET, HEAD, OPTIONS, POST" {
+		t.Fatal("Expected 405 with Allow header, got", w.Code, w.Header().Get("Allow"))
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("DELETE", "/missing", nil))
+	if w.Code != 404 {
+		t.Fatal("Expected 404 for missing path, got", w.Code)
+	}
+
+	r.MethodNotAllowed = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("PUT", "/posts/12", nil))
+	if w.Code != http.StatusTeapot || w.Header().Get("Allow") != "GET, HEAD, OPTIONS" {
+		t.Fatal("Expected custom MethodNotAllowed handler, got", w.Code, w.Header().Get("Allow"))
+	}
+}
+
+func TestHeadAndOptions(t *testing.T) {
+	r := NewRouter()
+	r.LogOutput = ioutil.Discard
+	r.Many(restCtrl{"posts", &BaseController{}})
+	r.Namespace("").Other("OPTIONS", "custom").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", "OPTIONS")
+		w.WriteHeader(http.StatusOK)
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("HEAD", "/posts/12", nil))
+	if w.Code != 200 || w.Body.Len() != 0 {
+		t.Fatal("Expected empty 200 for HEAD, got", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("OPTIONS", "/posts", nil))
+	if w.Code != 204 || w.Header().Get("Allow") != "GET, HEAD, OPTIONS" {
+		t.Fatal("Expected automatic OPTIONS response, got", w.Code, w.Header().Get("Allow"))
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("OPTIONS", "/custom", nil))
+	if w.Code != 200 || w.Header().Get("Allow") != "OPTIONS" {
+		t.Fatal("Expected registered OPTIONS handler, got", w.Code, w.Header().Get("Allow"))
+	}
+
+	var methods []string
+	r.OnOptions = func(w http.ResponseWriter, req *http.Request, allowed []string) {
+		methods = allowed
+		w.WriteHeader(http.StatusOK)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("OPTIONS", "/posts/12", nil))
+	if w.Code != 200 || len(methods) != 1 || methods[0] != "GET" {
+		t.Fatal("Expected OnOptions hook to be called, got", w.Code, methods)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	r := NewRouter()
+	r.LogOutput = ioutil.Discard
+	r.Many(restCtrl{"posts", &BaseController{}})
+	api := r.Namespace("api")
+	api.CORS(CORSPolicy{
+		AllowedOrigins:   []string{"https://*.example.com"},
+		AllowedHeaders:   []string{"Content-Type"},
+		AllowCredentials: true,
+		MaxAge:           time.Hour,
+	})
+	api.Many(restCtrl{"items", &BaseController{}})
+
+	req := httptest.NewRequest("OPTIONS", "/api/items", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	req.Header.Set("Access-Control-Request-Headers", "content-type")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != 204 ||
+		w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		w.Header().Get("Access-Control-Allow-Methods") != "GET, HEAD" ||
+		w.Header().Get("Access-Control-Allow-Headers") != "Content-Type" ||
+		w.Header().Get("Access-Control-Allow-Credentials") != "true" ||
+		w.Header().Get("Access-Control-Max-Age") != "3600" {
+		t.Fatal("Incorrect preflight response", w.Code, w.Header())
+	}
+
+	req.Header.Set("Access-Control-Request-Method", "DELETE")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("Preflight allowed an unrouted method", w.Header())
+	}
+
+	req = httptest.NewRequest("GET", "/api/items/12", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Body.String() != "Show: 12" || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Fatal("CORS headers missing from response", w.Header())
+	}
+
+	req.Header.Set("Origin", "https://evil.com")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("CORS headers set for disallowed origin", w.Header())
+	}
+
+	req = httptest.NewRequest("GET", "/posts/12", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("CORS headers set outside of SubRoute", w.Header())
+	}
+
+	// the Show under the policy declines, the one outside of it serves
+	r.Namespace("posts").One(declineCtrl{&BaseController{}}).CORS(CORSPolicy{
+		AllowedOrigins: []string{"*"},
+	})
+	req = httptest.NewRequest("GET", "/posts/special", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Body.String() != "Show: special" || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatal("CORS headers kept from a declined route", w.Body.String(), w.Header())
+	}
+}
+
+func TestConcurrentRoutes(t *testing.T) {
+	r := NewRouter()
+	r.LogOutput = ioutil.Discard
+	r.Many(restCtrl{"posts", &BaseController{}})
+	api := r.Namespace("api")
+	api.Get("version").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "v1")
+	})
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 50; i++ {
+			r.Namespace("plugins").Get(fmt.Sprint("p", i)).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, "plugin")
+			})
+			api.Replace(ModuleFunc(func(sr *SubRoute) {
+				sr.Get("version").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					io.WriteString(w, "v2")
+				})
+			}))
+		}
+		close(done)
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/api/version", nil))
+		if body := w.Body.String(); body != "v1" && body != "v2" {
+			t.Fatal("Request saw a partially replaced SubRoute:", w.Code, body)
+		}
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/posts/1", nil))
+		if w.Body.String() != "Show: 1" {
+			t.Fatal("Unexpected response:", w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/plugins/p49", nil))
+	if w.Body.String() != "plugin" {
+		t.Fatal("Route added at runtime was not served")
+	}
+
+	if !r.Remove("show_posts_path") || r.Remove("show_posts_path") {
+		t.Fatal("Remove did not report removed routes correctly")
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/posts/1", nil))
+	if w.Code != 404 {
+		t.Fatal("Removed route was still served:", w.Code)
+	}
+}
+
+func TestHostRouting(t *testing.T) {
+	r := NewRouter()
+	r.LogOutput = ioutil.Discard
+	r.Many(restCtrl{"posts", &BaseController{}})
+	r.Host("api.example.com").Get("posts").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "api")
+	})
+	r.Host(":tenant.example.com").Many(restCtrl{"pages", &BaseController{}})
+	admin := r.Host("admin.example.com:8443")
+	admin.Get("posts").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "admin")
+	})
+	admin.Many(restCtrl{"users", &BaseController{}})
+
+	tcs := []struct {
+		Host, Path, Body string
+		Code             int
+	}{
+		{"api.example.com", "/posts", "api", 200},
+		{"API.example.com:8080", "/posts", "api", 200},
+		{"api.example.com", "/posts/1", "Show: 1", 200},
+		{"www.example.com", "/posts", "Index", 200},
+		{"acme.example.com", "/pages/3", "Show: 3", 200},
+		{"example.com", "/pages/3", "", 404},
+		{"a.b.example.com", "/pages/3", "", 404},
+		{"admin.example.com:8443", "/posts", "admin", 200},
+		{"admin.example.com", "/posts", "Index", 200},
+		{"admin.example.com:8080", "/posts", "Index", 200},
+	}
+	for _, tc := range tcs {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", tc.Path, nil)
+		req.Host = tc.Host
+		r.ServeHTTP(w, req)
+		if w.Code != tc.Code || (tc.Body != "" && w.Body.String() != tc.Body) {
+			t.Errorf("%s%s: got %d %q", tc.Host, tc.Path, w.Code, w.Body.String())
+		}
+	}
+
+	m := r.routes.table().matcher.matchHost("acme.example.com", "/pages/3", 2)
+	if m.ID["tenant"] != "acme" || m.ID["pages"] != "3" {
+		t.Error("Host params missing from ID:", m.ID)
+	}
+
+	u, err := r.URLFor("show_pages_path", map[string]string{"tenant": "acme", "pages": "3"}, nil)
+	if err != nil || u != "http://acme.example.com/pages/3" {
+		t.Error("Unexpected URL:", u, err)
+	}
+	if _, err = r.URLFor("show_pages_path", map[string]string{"pages": "3"}, nil); err == nil {
+		t.Error("Expected an error for a missing host param")
+	}
+	u, err = r.URLFor("show_users_path", map[string]string{"users": "2"}, nil)
+	if err != nil || u != "http://admin.example.com:8443/users/2" {
+		t.Error("Unexpected URL:", u, err)
+	}
+}
+
+type fmtCtrl struct {
+	*BaseController
+}
+
+func (fmtCtrl) Path() string {
+	return "docs"
+}
+
+func (f fmtCtrl) Show() Result {
+	return f.RespondWith(map[string]func() Result{
+		"html": func() Result { return String{Content: "<p>" + f.ID["docs"] + "</p>"} },
+		"json": func() Result { return JSON(f.ID["docs"]) },
+	})
+}
+
+func TestFormats(t *testing.T) {
+	r := NewRouter()
+	r.LogOutput = ioutil.Discard
+	r.Many(fmtCtrl{&BaseController{}}).Formats("html", "json", "xml")
+	r.Many(restCtrl{"posts", &BaseController{}})
+	// the suffix doesn't replace a format param
+	r.Many(restCtrl{"format", &BaseController{}}).Formats("json")
+
+	tcs := []struct {
+		Path, Accept, Body string
+		Code               int
+	}{
+		{"/docs/1", "", "<p>1</p>", 200},
+		{"/docs/1.json", "", "\"1\"\n", 200},
+		{"/docs/1.html", "application/json", "<p>1</p>", 200},
+		{"/docs/1", "application/json", "\"1\"\n", 200},
+		{"/docs/1", "text/*;q=0.5, application/json;q=0.9", "\"1\"\n", 200},
+		{"/docs/1", "application/xml, */*;q=0.1", "<p>1</p>", 200},
+		{"/docs/1", "image/png", "", 406},
+		{"/docs/1.xml", "", "", 406},
+		{"/docs/1.csv", "", "<p>1.csv</p>", 200},
+		{"/posts/1.json", "", "Show: 1.json", 200},
+		{"/format/csv.json", "", "Show: csv", 200},
+	}
+	for _, tc := range tcs {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", tc.Path, nil)
+		if tc.Accept != "" {
+			req.Header.Set("Accept", tc.Accept)
+		}
+		r.ServeHTTP(w, req)
+		if w.Code != tc.Code || (tc.Body != "" && w.Body.String() != tc.Body) {
+			t.Errorf("%s (%s): got %d %q", tc.Path, tc.Accept, w.Code, w.Body.String())
+		}
+	}
+
+	u, err := r.URLFor("show_docs_path", map[string]string{"docs": "1", "format": "json"}, nil)
+	if err != nil || u != "/docs/1.json" {
+		t.Error("Unexpected URL:", u, err)
+	}
+}
+
+func TestDataResults(t *testing.T) {
+	f, err := ioutil.TempFile("", "report*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	io.WriteString(f, "file contents")
+	f.Close()
+
+	stream := make(chan []string, 2)
+	stream <- []string{"a", "b"}
+	stream <- []string{"c", "d,e"}
+	close(stream)
+
+	tcs := []struct {
+		Result      Result
+		Code        int
+		ContentType string
+		Body        string
+		Disposition string
+	}{
+		{XML(struct {
+			XMLName struct{} `xml:"post"`
+			ID      int      `xml:"id"`
+		}{ID: 1}), 200, "application/xml; charset=utf-8", xml.Header + "<post><id>1</id></post>", ""},
+		{&XMLData{Data: 1, Status: 201}, 201, "application/xml; charset=utf-8", xml.Header + "<int>1</int>", ""},
+		{CSV([][]string{{"id", "name"}, {"1", "Post"}}), 200, "text/csv; charset=utf-8", "id,name\n1,Post\n", ""},
+		{CSVStream(stream), 200, "text/csv; charset=utf-8", "a,b\nc,\"d,e\"\n", ""},
+		{CSVSeq(func(yield func([]string) bool) {
+			for _, s := range []string{"x", "y", "z"} {
+				if !yield([]string{s}) {
+					return
+				}
+			}
+		}), 200, "text/csv; charset=utf-8", "x\ny\nz\n", ""},
+		{Bytes("image/png", []byte("png")), 200, "image/png", "png", ""},
+		{&BytesData{Data: []byte("plain"), Status: 202}, 202, "text/plain; charset=utf-8", "plain", ""},
+		{File(f.Name()), 200, "text/plain; charset=utf-8", "file contents", ""},
+		{&FileData{Path: f.Name(), Filename: "a b.csv"}, 200, "text/csv; charset=utf-8", "file contents", `attachment; filename="a b.csv"`},
+		{File(f.Name() + ".missing"), 404, "text/plain; charset=utf-8", "404 page not found\n", ""},
+		{Download("report.json", strings.NewReader("{}")), 200, "application/json", "{}", "attachment; filename=report.json"},
+		{&DownloadData{Filename: "data", Content: strings.NewReader("?"), Status: 203}, 203, "application/octet-stream", "?", "attachment; filename=data"},
+	}
+	for i, tc := range tcs {
+		w := httptest.NewRecorder()
+		tc.Result.SetRequest(httptest.NewRequest("GET", "/", nil))
+		tc.Result.Execute(w)
+		if w.Code != tc.Code || w.Header().Get("Content-Type") != tc.ContentType ||
+			w.Body.String() != tc.Body || w.Header().Get("Content-Disposition") != tc.Disposition {
+			t.Errorf("%d %s: got %d %q %q %q", i, tc.Result, w.Code, w.Header().Get("Content-Type"), w.Body.String(), w.Header().Get("Content-Disposition"))
+		}
+	}
+}
+
+func TestResultHeaders(t *testing.T) {
+	tcs := []struct {
+		Result      Result
+		URL         string
+		Code        int
+		ContentType string
+		Body        string
+	}{
+		{JSON(1), "/", 200, "application/json; charset=utf-8", "1\n"},
+		{JSONData{Data: 1, Status: 201}, "/", 201, "application/json; charset=utf-8", "1\n"},
+		{JSONP(1), "/?callback=jQuery.cb_1", 200, "application/javascript; charset=utf-8", "/**/jQuery.cb_1(1\n);"},
+		{JSONP(1), "/?callback=alert(1)//", 400, "text/plain; charset=utf-8", "400 invalid callback\n"},
+		{JSONP(1), "/", 200, "application/json; charset=utf-8", "1\n"},
+		{String{Content: "gone", Status: 410}, "/", 410, "text/plain; charset=utf-8", "gone"},
+		{InternalError{fmt.Errorf("oops")}, "/", 500, "text/html; charset=utf-8", "<h1>Internal Server Error</h1>"},
+		{WithStatus(JSON(1), 202), "/", 202, "application/json; charset=utf-8", "1\n"},
+		{WithStatus(String{Content: "x", Status: 200}, 418), "/", 418, "text/plain; charset=utf-8", "x"},
+		{WithHeader(WithStatus(Text("csv"), 201), "Content-Type", "text/csv"), "/", 201, "text/csv", "csv"},
+		{WithStatus(NothingResult{}, 204), "/", 204, "", ""},
+	}
+	for i, tc := range tcs {
+		w := httptest.NewRecorder()
+		tc.Result.SetRequest(httptest.NewRequest("GET", tc.URL, nil))
+		tc.Result.Execute(w)
+		if w.Code != tc.Code || w.Header().Get("Content-Type") != tc.ContentType || w.Body.String() != tc.Body {
+			t.Errorf("%d %s: got %d %q %q", i, tc.Result, w.Code, w.Header().Get("Content-Type"), w.Body.String())
+		}
+	}
+
+	if err, ok := resultError(WithHeader(InternalError{fmt.Errorf("oops")}, "X-A", "b")); !ok || err.Error() != "oops" {
+		t.Error("Decorated InternalError was not handled as an error")
+	}
+}
+
+type sseCtrl struct {
+	*BaseController
+	Events  chan Event
+	Stopped chan error
+}
+
+func (sseCtrl) Path() string {
+	return "live"
+}
+
+func (c sseCtrl) Index() Result {
+	return &SSEData{Events: c.Events, Heartbeat: 10 * time.Millisecond}
+}
+
+func (c sseCtrl) Show() Result {
+	return SSEFunc(func(lastID string, send func(Event) error) {
+		for i := 1; ; i++ {
+			if err := send(Event{ID: fmt.Sprint(lastID, ".", i), Data: "tick"}); err != nil {
+				c.Stopped <- err
+				return
+			}
+		}
+	})
+}
+
+func TestSSE(t *testing.T) {
+	r := NewRouter()
+	r.LogOutput = ioutil.Discard
+	events := make(chan Event)
+	stopped := make(chan error, 1)
+	r.Many(sseCtrl{&BaseController{}, events, stopped})
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	resp, err := http.Head(s.URL + "/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); resp.StatusCode != 200 || ct != "text/event-stream" {
+		t.Fatalf("Unexpected HEAD response: %d %s", resp.StatusCode, ct)
+	}
+
+	resp, err = http.Get(s.URL + "/live")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatal("Unexpected Content-Type:", ct)
+	}
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		events <- Event{ID: "1", Event: "update", Data: "a\nb\r\nc\rd", Retry: time.Second}
+		close(events)
+	}()
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), ": heartbeat\n\n") ||
+		!strings.HasSuffix(string(body), "id: 1\nevent: update\nretry: 1000\ndata: a\ndata: b\ndata: c\ndata: d\n\n") {
+		t.Fatalf("Unexpected stream: %q", body)
+	}
+
+	req, _ := http.NewRequest("GET", s.URL+"/live/resume", nil)
+	req.Header.Set("Last-Event-ID", "41")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := make([]byte, len("id: 41.1\n"))
+	io.ReadFull(resp.Body, line)
+	resp.Body.Close()
+	if string(line) != "id: 41.1\n" {
+		t.Fatalf("Stream did not resume: %q", line)
+	}
+	select {
+	case err := <-stopped:
+		if err != ErrClientGone {
+			t.Fatal("Unexpected error:", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stream was not stopped after the client disconnected")
+	}
+}
+
+type userKey struct{}
+
+type ctxCtrl struct {
+	*BaseController
+}
+
+func (ctxCtrl) Path() string {
+	return "ctx"
+}
+
+func (c ctxCtrl) PreFilter() Result {
+	c.SetValue(userKey{}, "bob")
+	if c.Request.URL.Query().Get("skip") != "" {
+		return NotFound{}
+	}
+	return nil
+}
+
+func (c ctxCtrl) Index() Result {
+	return String{Content: c.Value(userKey{}).(string)}
+}
+
+func (c ctxCtrl) Show() Result {
+	if _, ok := c.Ctx().Deadline(); !ok {
+		return String{Content: "no deadline"}
+	}
+	<-c.Ctx().Done()
+	return String{Content: "too late"}
+}
+
+func TestRequestContext(t *testing.T) {
+	r := NewRouter()
+	r.LogOutput = ioutil.Discard
+	r.Many(ctxCtrl{&BaseController{}})
+	slow := r.Namespace("slow")
+	slow.Timeout(10 * time.Millisecond)
+	slow.Many(ctxCtrl{&BaseController{}})
+	r.SetHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user, _ := req.Context().Value(userKey{}).(string)
+		io.WriteString(w, "fallback "+user)
+	}))
+
+	tcs := []struct {
+		Path, Body string
+		Code       int
+	}{
+		{"/ctx", "bob", 200},
+		{"/ctx?skip=1", "fallback ", 200},
+		{"/ctx/1", "no deadline", 200},
+		{"/slow/ctx/1", "503 service unavailable\n", 503},
+	}
+	for _, tc := range tcs {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", tc.Path, nil))
+		if w.Code != tc.Code || w.Body.String() != tc.Body {
+			t.Errorf("%s: got %d %q", tc.Path, w.Code, w.Body.String())
+		}
+	}
+
+	bc := &BaseController{}
+	bc.SetValue(userKey{}, "alice")
+	if bc.Value(userKey{}) != "alice" {
+		t.Error("Value was not stored outside of a Router")
+	}
+}
+
+type cacheCtrl struct {
+	*BaseController
+}
+
+func (cacheCtrl) Path() string {
+	return "visits"
+}
+
+func (c cacheCtrl) Index() Result {
+	v, _ := c.Cache.Fetch("visits", 0, func() (interface{}, error) { return new(int), nil })
+	*v.(*int)++
+	return String{Content: fmt.Sprint(*v.(*int))}
+}
+
+func TestSharedCache(t *testing.T) {
+	r := NewRouter()
+	r.LogOutput = ioutil.Discard
+	r.Many(cacheCtrl{&BaseController{}})
+	for i := 1; i <= 3; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/visits", nil))
+		if w.Body.String() != fmt.Sprint(i) {
+			t.Fatal("Cache was not shared between requests:", w.Body.String())
+		}
+	}
+	if _, ok := r.Cache.Get("visits"); !ok {
+		t.Error("Controllers were not given the Router's Cache")
+	}
+}
+
+type greeter interface {
+	Greet() string
+}
+
+type fakeDB struct {
+	name string
+}
+
+func (db *fakeDB) Greet() string {
+	return "hello from " + db.name
+}
+
+type fakeTx struct {
+	id     int
+	closed bool
+}
+
+type Services struct {
+	Greeter greeter `inject:""`
+	Tx      *fakeTx `inject:""`
+}
+
+type svcCtrl struct {
+	*BaseController
+	*Services
+	DB      *fakeDB `inject:""`
+	Replica *fakeDB `inject:"replica"`
+	Tx      *fakeTx `inject:""`
+}
+
+func (svcCtrl) Path() string {
+	return "svc"
+}
+
+func (c svcCtrl) Index() Result {
+	return String{Content: fmt.Sprintf("%s %s %s %d %v", c.Greeter.Greet(), c.DB.name, c.Replica.name, c.Tx.id, c.Tx == c.Services.Tx)}
+}
+
+type guardedSvcCtrl struct {
+	svcCtrl
+}
+
+func (guardedSvcCtrl) Path() string {
+	return "guarded"
+}
+
+func (c guardedSvcCtrl) PreFilter() Result {
+	if c.Request.URL.Query().Get("login") == "" {
+		return RedirectError{Location: "/login"}
+	}
+	return nil
+}
+
+func TestInjection(t *testing.T) {
+	r := NewRouter()
+	r.LogOutput = ioutil.Discard
+	r.Many(svcCtrl{BaseController: &BaseController{}, Services: &Services{}})
+	r.Many(guardedSvcCtrl{svcCtrl{BaseController: &BaseController{}, Services: &Services{}}})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/svc", nil))
+	if w.Code != 500 {
+		t.Fatal("Expected an error for missing services, got", w.Code)
+	}
+
+	r.Provide(&fakeDB{"primary"})
+	r.ProvideNamed("replica", &fakeDB{"replica"})
+	txs := []*fakeTx{}
+	r.ProvideRequest(func(req *http.Request) (*fakeTx, func(), error) {
+		tx := &fakeTx{id: len(txs) + 1}
+		txs = append(txs, tx)
+		SetValue(req, "tx", tx.id)
+		return tx, func() { tx.closed = true }, nil
+	})
+
+	for i := 1; i <= 2; i++ {
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/svc", nil))
+		if body := fmt.Sprintf("hello from primary primary replica %d true", i); w.Body.String() != body {
+			t.Fatalf("Expected %q, got %d %q", body, w.Code, w.Body.String())
+		}
+	}
+	if len(txs) != 2 || !txs[0].closed || !txs[1].closed {
+		t.Error("Request scoped services were not created once per request and cleaned up")
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/guarded", nil))
+	if w.Code != 302 || len(txs) != 2 {
+		t.Errorf("Expected a redirect without a new service, got %d and %d services", w.Code, len(txs))
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/guarded?login=1", nil))
+	if body := "hello from primary primary replica 3 true"; w.Body.String() != body {
+		t.Errorf("Expected %q, got %d %q", body, w.Code, w.Body.String())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic for an invalid provider")
+		}
+	}()
+	r.ProvideRequest(func() *fakeTx { return nil })
+}
+
+type bindAddress struct {
+	City string `form:"city"`
+	Zip  int    `form:"zip"`
+}
+
+type bindForm struct {
+	Name     string        `form:"name"`
+	Age      int           `form:"age"`
+	Admin    bool          `form:"admin"`
+	Score    float64       `json:"score"`
+	Tags     []string      `form:"tags"`
+	IDs      []int64       `form:"ids"`
+	Born     time.Time     `form:"born"`
+	At       time.Time     `form:"at" time:"15:04"`
+	Timeout  time.Duration `form:"timeout"`
+	Nick     *string       `form:"nick"`
+	Address  bindAddress   `form:"address"`
+	Billing  *bindAddress  `form:"billing"`
+	Upload   *multipart.FileHeader
+	Ignored  string `form:"-"`
+	internal string
+}
+
+func TestBind(t *testing.T) {
+	req := httptest.NewRequest("POST", "/?name=query&tags=a&tags=b&ids[]=1&ids[]=2", strings.NewReader(
+		"age=30&admin=on&score=1.5&born=2001-02-03&at=10:30&timeout=1m&nick=jj&address.city=Paris&address.zip=75001&Ignored=x",
+	))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var f bindForm
+	if err := (BaseController{Request: req}).Bind(&f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Name != "query" || f.Age != 30 || !f.Admin || f.Score != 1.5 ||
+		len(f.Tags) != 2 || f.Tags[1] != "b" || len(f.IDs) != 2 || f.IDs[1] != 2 ||
+		f.Born.Year() != 2001 || f.At.Hour() != 10 || f.Timeout != time.Minute ||
+		f.Nick == nil || *f.Nick != "jj" || f.Address.City != "Paris" || f.Address.Zip != 75001 ||
+		f.Billing != nil || f.Ignored != "" {
+		t.Errorf("Unexpected form binding: %+v", f)
+	}
+
+	req = httptest.NewRequest("POST", "/?age=old", strings.NewReader("admin=maybe&address.zip=abc&billing.city=Rome"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	f = bindForm{}
+	err := (BaseController{Request: req}).Bind(&f)
+	errs, ok := err.(BindErrors)
+	if !ok || len(errs) != 3 {
+		t.Fatal("Expected 3 errors, got", err)
+	}
+	if be, ok := errs.Field("address.zip"); !ok || be.Value != "abc" {
+		t.Error("Missing error for address.zip:", errs)
+	}
+	if f.Billing == nil || f.Billing.City != "Rome" {
+		t.Error("Nested pointer struct was not bound:", f.Billing)
+	}
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	mw.WriteField("name", "multi")
+	fw, _ := mw.CreateFormFile("Upload", "a.txt")
+	io.WriteString(fw, "file")
+	mw.Close()
+	req = httptest.NewRequest("POST", "/", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	f = bindForm{}
+	if err := (BaseController{Request: req}).Bind(&f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Name != "multi" || f.Upload == nil || f.Upload.Filename != "a.txt" {
+		t.Errorf("Unexpected multipart binding: %+v", f)
+	}
+
+	req = httptest.NewRequest("POST", "/?age=5", strings.NewReader(`{"Name": "json", "score": 2}`))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	f = bindForm{}
+	if err := (BaseController{Request: req}).Bind(&f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Name != "json" || f.Score != 2 || f.Age != 5 {
+		t.Errorf("Unexpected JSON binding: %+v", f)
+	}
+
+	req = httptest.NewRequest("POST", "/", strings.NewReader(`{"score": "high", "age": true, "address": {"zip": "x"}}`))
+	req.Header.Set("Content-Type", "application/json")
+	err = (BaseController{Request: req}).Bind(&f)
+	errs, ok = err.(BindErrors)
+	if !ok || len(errs) != 3 {
+		t.Fatal("Expected 3 errors, got", err)
+	}
+	if be, ok := errs.Field("score"); !ok || be.Value != `"high"` {
+		t.Error("Missing error for score:", errs)
+	}
+	if _, ok := errs.Field("address.zip"); !ok {
+		t.Error("Missing error for address.zip:", errs)
+	}
+
+	req = httptest.NewRequest("POST", "/", strings.NewReader("name=blank&age=&score=&address.zip="))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	f = bindForm{Age: 3}
+	if err := (BaseController{Request: req}).Bind(&f); err != nil || f.Age != 0 || f.Score != 0 {
+		t.Errorf("Expected empty numbers to be zero, got %+v %v", f, err)
+	}
+	if err = (BaseController{Request: req}).Bind(f); err == nil {
+		t.Error("Expected an error binding to a non-pointer")
+	}
+}
+
+func TestTypedIDs(t *testing.T) {
+	bc := BaseController{ID: map[string]string{
+		"big":  "9007199254740993",
+		"uuid": "0F8FAD5B-D9CB-469F-A165-70867728950E",
+		"bad":  "0f8fad5b",
+		"name": "post",
+	}}
+	if i, ok := bc.Int64ID("big"); !ok || i != 9007199254740993 {
+		t.Error("Unexpected Int64ID:", i, ok)
+	}
+	if _, ok := bc.Int64ID("name"); ok {
+		t.Error("Int64ID accepted a non-integer")
+	}
+	if u, ok := bc.UUIDID("uuid"); !ok || u != "0f8fad5b-d9cb-469f-a165-70867728950e" {
+		t.Error("Unexpected UUIDID:", u, ok)
+	}
+	if _, ok := bc.UUIDID("bad"); ok {
+		t.Error("UUIDID accepted an invalid UUID")
+	}
+	if s, ok := bc.StringID("name"); !ok || s != "post" {
+		t.Error("Unexpected StringID:", s, ok)
+	}
+	if _, ok := bc.StringID("missing"); ok {
+		t.Error("StringID found a missing param")
+	}
+}
@@ -0,0 +1,157 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Event is a Server-Sent Event, only Data is required.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	// Retry sets how long the client waits before reconnecting
+	Retry time.Duration
+}
+
+// ErrClientGone is returned by the send function of SSEFunc once the
+// client has disconnected.
+var ErrClientGone = errors.New("Client disconnected")
+
+// DefaultHeartbeat is how often a comment is sent to keep idle event
+// streams open.
+var DefaultHeartbeat = 15 * time.Second
+
+// SSE returns a Result that streams events to the client until events
+// is closed or the client disconnects.
+func SSE(events <-chan Event) Result {
+	return &SSEData{Events: events}
+}
+
+// SSEFunc returns a Result that calls stream with the Last-Event-ID sent
+// by a reconnecting client, the stream ends when stream returns.
+func SSEFunc(stream func(lastEventID string, send func(Event) error)) Result {
+	return &SSEData{Stream: stream}
+}
+
+type SSEData struct {
+	Events <-chan Event
+	Stream func(lastEventID string, send func(Event) error)
+	// Heartbeat defaults to DefaultHeartbeat, a negative Heartbeat
+	// disables heartbeats
+	Heartbeat time.Duration
+	request   *http.Request
+}
+
+func (r *SSEData) SetRequest(req *http.Request) {
+	r.request = req
+}
+
+func (r SSEData) Execute(w http.ResponseWriter) {
+	// HEAD requests only get the headers of the stream
+	if r.request != nil && r.request.Method == "HEAD" {
+		r.writeHeader(w)
+		return
+	}
+	f, ok := w.(http.Flusher)
+	if !ok || r.request == nil {
+		http.Error(w, "500 streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	r.writeHeader(w)
+	f.Flush()
+
+	done := r.request.Context().Done()
+	events := r.Events
+	if r.Stream != nil {
+		ch := make(chan Event)
+		events = ch
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			defer close(ch)
+			r.Stream(r.request.Header.Get("Last-Event-ID"), func(e Event) error {
+				select {
+				case ch <- e:
+					return nil
+				case <-stop:
+					return ErrClientGone
+				case <-done:
+					return ErrClientGone
+				}
+			})
+		}()
+	}
+
+	var heartbeat <-chan time.Time
+	interval := r.Heartbeat
+	if interval == 0 {
+		interval = DefaultHeartbeat
+	}
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		heartbeat = t.C
+	}
+
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if writeEvent(w, e) != nil {
+				return
+			}
+		case <-heartbeat:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-done:
+			return
+		}
+		f.Flush()
+	}
+}
+
+func (r SSEData) writeHeader(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (r SSEData) String() string {
+	return "Server-Sent Events"
+}
+
+func writeEvent(w io.Writer, e Event) error {
+	var b strings.Builder
+	if e.ID != "" {
+		fmt.Fprintf(&b, "id: %s\n", oneLine(e.ID))
+	}
+	if e.Event != "" {
+		fmt.Fprintf(&b, "event: %s\n", oneLine(e.Event))
+	}
+	if e.Retry > 0 {
+		fmt.Fprintf(&b, "retry: %d\n", e.Retry/time.Millisecond)
+	}
+	for _, line := range strings.Split(lineBreaks.Replace(e.Data), "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// lineBreaks normalizes the line breaks allowed in an event stream.
+var lineBreaks = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+// oneLine removes line breaks that would end a field early.
+func oneLine(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
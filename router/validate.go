@@ -0,0 +1,198 @@
+package router
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// ConflictKind describes the problem found with a route.
+type ConflictKind string
+
+const (
+	// DuplicateRoute is reported for leaves with the same method, scheme
+	// and path, only the first leaf will be used.
+	DuplicateRoute ConflictKind = "duplicate route"
+	// DuplicateName is reported when different actions share a name.
+	DuplicateName ConflictKind = "duplicate name"
+	// ShadowedRoute is reported for dynamic segments that can't be reached
+	// because an earlier segment accepts the same values.
+	ShadowedRoute ConflictKind = "shadowed route"
+	// MissingAction is reported for leaves whose controller doesn't have
+	// the action method.
+	MissingAction ConflictKind = "missing action"
+	// InvalidDupe is reported for controllers that CheckDupe finds
+	// problems with.
+	InvalidDupe ConflictKind = "invalid dupe"
+)
+
+// RouteConflict is a problem found with the routes of a Router.
+type RouteConflict struct {
+	Kind    ConflictKind
+	Path    string
+	Message string
+	Leaves  []Leaf
+}
+
+func (rc RouteConflict) Error() string {
+	return fmt.Sprintf("%s at '%s': %s", rc.Kind, rc.Path, rc.Message)
+}
+
+// Validate checks every route in the Router, reporting duplicate routes,
+// duplicate route names, shadowed dynamic routes, actions missing from
+// their controller, and controllers that can't be duplicated.
+func (r *Router) Validate() []RouteConflict {
+	var conflicts []RouteConflict
+	r.Tree.Branch.view(func() {
+		conflicts = r.Tree.Validate()
+	})
+	return conflicts
+}
+
+// Strict makes the Router panic with a RouteConflict when a route is
+// registered that Validate would report.
+func (r *Router) Strict() {
+	r.Tree.Branch.edit(func() {
+		r.Tree.Branch.onConflict = func(rc RouteConflict) {
+			panic(rc)
+		}
+	})
+	if conflicts := r.Validate(); len(conflicts) > 0 {
+		panic(conflicts[0])
+	}
+}
+
+// Validate checks every route in the tree, see Router.Validate.
+func (rt RetrieveTree) Validate() []RouteConflict {
+	conflicts := []RouteConflict{}
+	names := map[string]Leaf{}
+	br := []*Branch{rt.Branch}
+	for len(br) > 0 {
+		brz := br[0]
+		br = br[1:]
+		for _, err := range brz.Conflicts {
+			if rc, ok := err.(RouteConflict); ok {
+				conflicts = append(conflicts, rc)
+			}
+		}
+
+		for i, leaf := range brz.Leaves {
+			for _, prev := range brz.Leaves[:i] {
+				if duplicateLeaf(prev, leaf) {
+					conflicts = append(conflicts, duplicateConflict(prev, leaf))
+					break
+				}
+			}
+			if leaf.Name != "" {
+				if prev, ok := names[leaf.Name]; ok && !sameAction(prev, leaf) {
+					conflicts = append(conflicts, nameConflict(prev, leaf))
+				} else if !ok {
+					names[leaf.Name] = leaf
+				}
+			}
+			if rc, ok := missingAction(leaf); ok {
+				conflicts = append(conflicts, rc)
+			}
+		}
+		br = append(br, brz.children()...)
+	}
+	return conflicts
+}
+
+// leafConflicts checks a single leaf that was just inserted into br.
+func (rt RetrieveTree) leafConflicts(br *Branch, leaf Leaf) []RouteConflict {
+	conflicts := []RouteConflict{}
+	for _, prev := range br.Leaves[:len(br.Leaves)-1] {
+		if duplicateLeaf(prev, leaf) {
+			conflicts = append(conflicts, duplicateConflict(prev, leaf))
+			break
+		}
+	}
+	if leaf.Name != "" {
+		if prev, ok := rt.findOtherLeaf(leaf.Name, br); ok && !sameAction(prev, leaf) {
+			conflicts = append(conflicts, nameConflict(prev, leaf))
+		}
+	}
+	if rc, ok := missingAction(leaf); ok {
+		conflicts = append(conflicts, rc)
+	}
+	return conflicts
+}
+
+// findOtherLeaf is FindLeaf, but skips the leaf that was just inserted
+// into br, which may be found first when it is shallower.
+func (rt RetrieveTree) findOtherLeaf(name string, br *Branch) (Leaf, bool) {
+	branches := []*Branch{rt.Branch}
+	for len(branches) > 0 {
+		current := branches[0]
+		branches = branches[1:]
+		for i, leaf := range current.Leaves {
+			if leaf.Name == name && (current != br || i != len(current.Leaves)-1) {
+				return leaf, true
+			}
+		}
+		branches = append(branches, current.children()...)
+	}
+	return Leaf{}, false
+}
+
+func duplicateLeaf(a, b Leaf) bool {
+	return a.Method == b.Method && a.Scheme == b.Scheme
+}
+
+// sameAction allows a name to be used for several leaves of the same
+// action, like the DELETE and POST routes for Delete.
+func sameAction(a, b Leaf) bool {
+	return a.Action == b.Action && ctrlType(a.Ctrl) == ctrlType(b.Ctrl)
+}
+
+func ctrlType(ctrl DupableController) reflect.Type {
+	if adc, ok := ctrl.(autoDupeCtrl); ok {
+		return reflect.TypeOf(adc.Controller)
+	}
+	return reflect.TypeOf(ctrl)
+}
+
+func duplicateConflict(prev, leaf Leaf) RouteConflict {
+	return RouteConflict{
+		Kind: DuplicateRoute,
+		Path: leaf.Path,
+		Message: fmt.Sprintf(
+			"%s %s.%s is shadowed by %s.%s",
+			leaf.Method, ctrlName(leaf.Ctrl), leaf.Action,
+			ctrlName(prev.Ctrl), prev.Action,
+		),
+		Leaves: []Leaf{prev, leaf},
+	}
+}
+
+func nameConflict(prev, leaf Leaf) RouteConflict {
+	return RouteConflict{
+		Kind: DuplicateName,
+		Path: leaf.Path,
+		Message: fmt.Sprintf(
+			"Route name '%s' is already used by '%s'",
+			leaf.Name, prev.Path,
+		),
+		Leaves: []Leaf{prev, leaf},
+	}
+}
+
+func missingAction(leaf Leaf) (RouteConflict, bool) {
+	if leaf.Action == "Custom" || leaf.Callable == nil {
+		return RouteConflict{}, false
+	}
+	rc := RouteConflict{
+		Kind:   MissingAction,
+		Path:   leaf.Path,
+		Leaves: []Leaf{leaf},
+	}
+	if leaf.Ctrl == nil {
+		rc.Message = fmt.Sprintf("No controller for action %s", leaf.Action)
+		return rc, true
+	}
+	if !reflect.ValueOf(leaf.Ctrl.Dupe()).MethodByName(leaf.Action).IsValid() {
+		rc.Message = fmt.Sprintf("%s is missing action %s", ctrlName(leaf.Ctrl), leaf.Action)
+		return rc, true
+	}
+	return RouteConflict{}, false
+}